@@ -2,9 +2,10 @@
 //
 // Carchivum supports zip and tar. For tar, archiver also supports
 // the following compression:
-//    gzip
-//    bzip2
-//    lz4
+//
+//	gzip
+//	bzip2
+//	lz4
 //
 // When creating a tar, compression is not optional. Carchivum does not support
 // everything tar does.  If a compression algorithm is used that tar does not support,
@@ -13,15 +14,23 @@
 package carchivum
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/MichaelTJones/walk"
 	magicnum "github.com/mohae/magicnum/compress"
 )
 
@@ -46,12 +55,53 @@ type Car struct {
 	Name       string
 	UseLongExt bool
 	OutDir     string
+	// Transform are sed-like rules, e.g. `s,^project-[^/]*/,app/,`, that
+	// rewrite the names of the files in the archive when it is created and
+	// of the files that are extracted; see parseTransform. Files whose name
+	// is rewritten to nothing are skipped.
+	Transform []string
 	// Create operation modifiers
 	Owner int
 	Group int
 	os.FileMode
+	// Prefix is prepended to the names of the archived files.
+	Prefix string
+	// Hash, if set, is used to compute a digest of each archived file's
+	// content; the digest is stored with the file's entry.
+	Hash crypto.Hash
+	// SignKey, if set, is used to sign the archive once it has been
+	// created; the signature is written to a detached signature file.
+	SignKey ed25519.PrivateKey
 	// Extract operation modifiers
 	UseFullpath bool
+	// Overwrite is how files that already exist are handled; extracted
+	// files are written to a temporary file that is renamed once it has
+	// been written.
+	Overwrite Overwrite
+	// StripComponents is the number of leading elements removed from the
+	// names of the extracted files, before the Transform rules are
+	// applied; files with fewer elements aren't extracted.
+	StripComponents int
+	// the parsed Transform rules.
+	transforms []transform
+	// VerifyDigests checks each extracted file against the digest stored
+	// with its entry. Entries without a digest, e.g. those of archives
+	// created without a Hash, aren't checked, and don't fail.
+	VerifyDigests bool
+	// VerifyKey, if set, is used to verify the archive's detached signature
+	// before anything is extracted.
+	VerifyKey ed25519.PublicKey
+	// Reproducible, if set, creates archives whose content only depends on
+	// the archived files' names and content, see reproducible.go.
+	Reproducible bool
+	// SourceDateEpoch, if set, is the latest modification time of a
+	// Reproducible archive's files; later times are clamped to it. If it
+	// isn't set, the SOURCE_DATE_EPOCH environment variable, the number of
+	// seconds since the Unix epoch, is used, if it is set.
+	SourceDateEpoch time.Time
+	// the entries of a Reproducible archive, which are sorted before they
+	// are written.
+	pending []pendingEntry
 	// Local file selection
 	// List of files to delete if applicable.
 	deleteList     []string
@@ -66,16 +116,117 @@ type Car struct {
 	IncludeExt      []string
 	IncludeExtCount int
 	IncludeAnchored string
+	// IncludePatterns and ExcludePatterns are gitignore-style patterns,
+	// relative to each source's root, in which "**" matches any number of
+	// directories, e.g. "**/node_modules/" or "!keep.log". If there are
+	// IncludePatterns, only the files that match them, or are in a
+	// directory that does, are archived. Excluded directories aren't
+	// walked.
+	IncludePatterns []string
+	ExcludePatterns []string
+	// IgnoreFiles are the names of files, e.g. DefaultIgnoreFiles, that are
+	// read from each directory as it is walked; their gitignore patterns
+	// exclude files in that directory and its subdirectories.
+	IgnoreFiles []string
+	// the parsed patterns and, by directory relative to the root of the
+	// source being walked, the patterns of the ignore files.
+	includePatterns []pattern
+	excludePatterns []pattern
+	ignores         map[string][]pattern
 	// File time format handling
+	// Newer, if set, is the time that files must be modified after to be
+	// archived; it is either a date, e.g. "2006-01-02" or an RFC 3339 time,
+	// or a relative time, e.g. "7d", "36h", or "2 weeks ago", see
+	// ParseTime. NewerFile, if set, is a file whose modification time is
+	// used instead. NewerMTime, if set, is used instead of either.
 	Newer      string
 	NewerMTime time.Time
 	NewerFile  string
+	// Older, OlderFile, and OlderMTime are like Newer, NewerFile, and
+	// NewerMTime, but files must be modified before the time to be
+	// archived.
+	Older      string
+	OlderMTime time.Time
+	OlderFile  string
+	// the times files must be modified after, and before, to be archived;
+	// see setTimeFilters.
+	newer, older time.Time
+	// UseCTime compares the files' status change times, instead of their
+	// modification times, to the Newer and Older times. Files whose change
+	// time isn't available, e.g. on Windows, use their modification time.
+	UseCTime bool
+	// Types are the types of files that are archived; if it isn't set,
+	// DefaultTypes are. Symlinks are archived, not followed. Zips can't
+	// hold devices or named pipes.
+	Types FileType
+	// MinSize and MaxSize, if > 0, are the smallest and largest regular
+	// files that are archived.
+	MinSize int64
+	MaxSize int64
+	// IncludeOwner and IncludeGroup, if set, are the user and group, either
+	// a name or a numeric id, that files must be owned by to be archived.
+	IncludeOwner string
+	IncludeGroup string
+	// IncludePerm are the permission bits that files must all have, and
+	// ExcludePerm are those that they must not have any of, to be archived.
+	IncludePerm os.FileMode
+	ExcludePerm os.FileMode
+	// OneFileSystem doesn't walk directories that are on a different
+	// file system than the source, e.g. mount points.
+	OneFileSystem bool
+	// Hook, if set, is called with each file, and directory, that is
+	// selected to be archived; it can change how the file is archived, see
+	// Candidate, or skip it by returning false. It is called concurrently
+	// if the sources are OS paths.
+	Hook func(*Candidate) (bool, error)
+	// ContinueOnError, like tar's --ignore-failed-read, skips the files that
+	// can't be read, or the entries that can't be extracted, instead of
+	// stopping; their errors are returned, once the rest of the files have
+	// been processed, as a *PartialError. A file that fails once its
+	// content has started to be written to the archive, or an archive whose
+	// entries can't be found, still stops the operation.
+	ContinueOnError bool
+	// Logger, if set, logs each file that is added, skipped, or extracted,
+	// at the debug level, and the files that fail, at the error level.
+	Logger Logger
+	// Observer, if set, is notified of the progress as files are archived
+	// and extracted, see Event. PreScan walks the sources before the
+	// archive is created so that the events have the total number of
+	// files, and bytes, that are being archived.
+	Observer Observer
+	PreScan  bool
+	// the resolved IncludeOwner and IncludeGroup, and the device of the
+	// source being walked.
+	uid, gid int
+	rootDev  uint64
 	//	TimeFormats []string
 
 	// Output format for time
 	outputNameTimeFormat string
-	// Processing queue
+	// FileCh isn't used.
+	//
+	// Deprecated: the queue of files to be archived is internal.
 	FileCh chan *os.File
+	// the queue of files to be archived.
+	entries chan *entry
+	// the filesystem the sources are in when the archive is created from an
+	// fs.FS; otherwise the sources are OS paths.
+	fsys fs.FS
+	// the first error encountered while writing the queued files
+	werr error
+	// the context of the operation, if it has one, and the files and
+	// directories that have been extracted, which are removed if it is
+	// canceled, and the existing files, and their backups, that are
+	// restored; see context.go.
+	ctx       context.Context
+	extracted []string
+	backups   [][2]string
+	// the progress reported to the Observer, and the stats of the
+	// operation.
+	progress progress
+	stats    Stats
+	// the errors of the files that failed, see ContinueOnError.
+	failures []error
 	// Other Counters
 	files           int32
 	dirs            int32
@@ -100,77 +251,389 @@ func (c *Car) Message() string {
 	return fmt.Sprintf("%q created in %4f seconds\n%d files totalling %d bytes were processed", c.Name, c.𝛥t, c.files, c.bytes)
 }
 
+// entry is a file that is queued to be archived.
+type entry struct {
+	// Name is the file's name in the archive.
+	Name string
+	file fs.File
+	// the temporary file the content was spooled to, if any; see seekable.
+	tmp string
+	// the Hook's changes to the file, if any.
+	hook *Candidate
+	// the file's info when it was queued, and whether its header has been
+	// written to the archive.
+	info    os.FileInfo
+	written bool
+}
+
+// seekFile is a file whose content can be read more than once.
+type seekFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// seekable returns the entry's file as a seekFile. A file that isn't one,
+// e.g. a compressed file in a ZipFS, is spooled to a temporary file that is
+// removed when the entry is closed.
+func (e *entry) seekable() (seekFile, error) {
+	if f, ok := e.file.(seekFile); ok {
+		return f, nil
+	}
+	tmp, err := os.CreateTemp("", "carchivum")
+	if err != nil {
+		return nil, err
+	}
+	e.tmp = tmp.Name()
+	_, err = io.Copy(tmp, e.file)
+	e.file.Close()
+	e.file = tmp
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return tmp, nil
+}
+
+func (e *entry) close() error {
+	err := e.file.Close()
+	if e.tmp != "" {
+		os.Remove(e.tmp)
+	}
+	return err
+}
+
 // AddFile reads a file and pipes it to the zipper goroutine.
 func (c *Car) AddFile(root, p string, fi os.FileInfo, err error) error {
-	// Check fileInfo to see if this should be added to archive
-	process, err := c.filterFileInfo(fi)
+	if cerr := c.ctxErr(); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return c.failed(p, err)
+	}
+	var relPath string
+	relPath, err = filepath.Rel(root, p)
 	if err != nil {
 		return err
 	}
-	if !process {
+	if relPath == "," {
 		return nil
 	}
+	rel := filepath.ToSlash(relPath)
+	if fi.IsDir() {
+		err = c.readIgnoreFiles(rel, func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(p, name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if rel == "." {
+		return nil
+	}
+	if c.OneFileSystem && fi.IsDir() {
+		dev, ok := fileDevice(fi)
+		if ok && dev != c.rootDev {
+			c.skip(SkippedFileSystem, p)
+			return filepath.SkipDir
+		}
+	}
 	// Check path information to see if this should be added to archive
-	process, err = c.filterPath(root, p)
+	if c.ignored(rel, fi.IsDir()) {
+		c.skip(SkippedIgnored, p)
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	// Check fileInfo to see if this should be added to archive
+	process, err := c.filterFileInfo(p, fi)
 	if err != nil {
 		return err
 	}
 	if !process {
 		return nil
 	}
-	var relPath string
-	relPath, err = filepath.Rel(root, p)
+	process, err = c.filterPath(rel, fi.IsDir())
 	if err != nil {
 		return err
 	}
-	if relPath == "," {
+	if !process {
+		c.skip(SkippedFiltered, p)
 		return nil
 	}
-	fullpath := p
+	name := p
 	if !c.UseFullpath {
-		p = filepath.Join(filepath.Base(root), relPath)
+		name = filepath.Join(filepath.Base(root), relPath)
 	}
-	f, err := os.Open(p)
-	if err != nil {
+	queued, err := c.queue(p, filepath.ToSlash(name), fi, func() (fs.File, error) {
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return openSpecial(p, fi)
+		}
+		return os.Open(p)
+	})
+	if err != nil || !queued {
 		return err
 	}
 	c.mu.Lock()
-	c.files++
-	c.bytes += fi.Size()
 	if c.DeleteArchived {
-		c.deleteList = append(c.deleteList, fullpath)
+		c.deleteList = append(c.deleteList, p)
 	}
-	c.FileCh <- f
 	c.mu.Unlock()
 	return nil
 }
 
-func (c *Car) filterFileInfo(fi os.FileInfo) (bool, error) {
-	// Don't add symlinks, otherwise would have to code some cycle
-	// detection amongst other stuff.
-	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+// addFSFile is the fs.WalkDirFunc used to queue the files of a source, root,
+// in an fs.FS. The files are named by their path in the fs.FS.
+func (c *Car) addFSFile(root, p string, d fs.DirEntry, err error) error {
+	if err != nil {
+		return c.failed(p, err)
+	}
+	err = c.ctxErr()
+	if err != nil {
+		return err
+	}
+	rel := p
+	if root != "." {
+		rel = strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		if rel == "" {
+			rel = "."
+		}
+	}
+	if d.IsDir() {
+		err = c.readIgnoreFiles(rel, func(name string) ([]byte, error) {
+			return fs.ReadFile(c.fsys, path.Join(p, name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if rel == "." && d.IsDir() {
+		return nil
+	}
+	if c.ignored(rel, d.IsDir()) {
+		c.skip(SkippedIgnored, p)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+	process, err := c.filterFileInfo(p, fi)
+	if err != nil || !process {
+		return err
+	}
+	process, err = c.filterPath(rel, d.IsDir())
+	if err != nil {
+		return err
+	}
+	if !process {
+		c.skip(SkippedFiltered, p)
+		return nil
+	}
+	// only the regular files, and directories, of an fs.FS are archived.
+	if !fi.Mode().IsRegular() && !fi.IsDir() {
+		c.skip(SkippedUnsupported, p)
+		return nil
+	}
+	_, err = c.queue(p, p, fi, func() (fs.File, error) {
+		return c.fsys.Open(p)
+	})
+	return err
+}
+
+// queue passes the file at p, which is named name in the archive once the
+// Transform rules and Prefix are applied, to the Hook, if there is one.
+// Unless the hook skips it, the file is counted, opened, and sent to the
+// writer goroutine. If the archive is Reproducible, the file is held until
+// all of the sources have been walked, see sendPending. When the sources are
+// being scanned, see PreScan, the file is only counted.
+func (c *Car) queue(p, name string, fi os.FileInfo, open func() (fs.File, error)) (bool, error) {
+	name = c.memberName(name)
+	if name == "" {
+		c.skip(SkippedRenamed, p)
 		return false, nil
 	}
-	if c.NewerMTime != unsetTime {
-		if !fi.ModTime().After(c.NewerMTime) {
+	if c.progress.scanning {
+		c.scanned(fi.Size(), fi.IsDir())
+		return false, nil
+	}
+	e := &entry{Name: name}
+	if c.Hook != nil {
+		var ok bool
+		var err error
+		e, open, ok, err = c.callHook(p, name, fi, open)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			c.skip(SkippedHook, p)
 			return false, nil
 		}
 	}
-	return true, nil
+	if !c.Reproducible {
+		f, err := open()
+		if err != nil {
+			return false, c.failed(p, err)
+		}
+		e.file = f
+		fi, err = e.contentInfo(fi)
+		if err != nil {
+			e.close()
+			return false, c.failed(p, err)
+		}
+	}
+	e.info = fi
+	c.mu.Lock()
+	c.files++
+	c.bytes += fi.Size()
+	c.count(fi.Mode(), 1)
+	if c.Reproducible {
+		c.pending = append(c.pending, pendingEntry{e: e, open: open})
+		c.mu.Unlock()
+		return true, nil
+	}
+	c.mu.Unlock()
+	return true, c.send(e)
 }
 
-func (c *Car) filterPath(root, p string) (bool, error) {
-	if strings.HasSuffix(root, p) {
-		return false, nil
+// send sends e to the writer goroutine, unless the context is done first;
+// then e is closed.
+func (c *Car) send(e *entry) error {
+	defer func(t time.Time) {
+		c.mu.Lock()
+		c.stats.blocked += time.Since(t)
+		c.mu.Unlock()
+	}(time.Now())
+	if c.ctx == nil {
+		c.entries <- e
+		return nil
+	}
+	select {
+	case c.entries <- e:
+		return nil
+	case <-c.ctx.Done():
+		e.close()
+		return c.ctx.Err()
+	}
+}
+
+// addSources walks the sources and queues their files. The sources are paths
+// in fsys, if the archive is being created from an fs.FS, or OS paths.
+func (c *Car) addSources(src []string) error {
+	// the time spent blocked on the writer goroutine isn't walking.
+	defer func(t time.Time, blocked time.Duration) {
+		c.stats.Walk += time.Since(t) - (c.stats.blocked - blocked)
+	}(time.Now(), c.stats.blocked)
+	if c.Reproducible {
+		err := c.setEpoch()
+		if err != nil {
+			return err
+		}
+		c.pending = nil
 	}
-	b, err := c.includeFile(root, p)
+	c.parseFilterPatterns()
+	err := c.setTimeFilters()
 	if err != nil {
-		return false, err
+		return err
+	}
+	err = c.setSelection()
+	if err != nil {
+		return err
+	}
+	err = c.setTransforms()
+	if err != nil {
+		return err
+	}
+	if c.fsys != nil {
+		for _, source := range src {
+			c.ignores = nil
+			err := fs.WalkDir(c.fsys, source, func(p string, d fs.DirEntry, err error) error {
+				return c.addFSFile(source, p, d, err)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return c.sendPending()
+	}
+	var fullPath string
+	visitor := func(p string, fi os.FileInfo, err error) error {
+		return c.AddFile(fullPath, p, fi, err)
 	}
-	if !b {
+	for _, source := range src {
+		// first get the absolute, its needed either way
+		var err error
+		fullPath, err = filepath.Abs(source)
+		if err != nil {
+			return err
+		}
+		c.ignores = nil
+		if c.OneFileSystem {
+			fi, err := os.Lstat(fullPath)
+			if err != nil {
+				return err
+			}
+			c.rootDev, _ = fileDevice(fi)
+		}
+		err = walk.Walk(fullPath, visitor)
+		if err != nil {
+			return err
+		}
+	}
+	return c.sendPending()
+}
+
+// filterFileInfo returns whether the file at p, whose info is fi, is selected
+// and within the Newer and Older times.
+func (c *Car) filterFileInfo(p string, fi os.FileInfo) (bool, error) {
+	// Symlinks are only added, not followed, so there aren't any cycles.
+	if !c.selectFile(fi) {
+		c.skip(SkippedSelection, p)
 		return false, nil
 	}
-	b, err = c.excludeFile(root, p)
+	// a directory's times don't reflect those of the files in it.
+	if fi.IsDir() {
+		return true, nil
+	}
+	t := fi.ModTime()
+	if c.UseCTime {
+		t = changeTime(fi)
+	}
+	if c.newer != unsetTime {
+		if !t.After(c.newer) {
+			c.skip(SkippedTime, p)
+			return false, nil
+		}
+	}
+	if c.older != unsetTime {
+		if !t.Before(c.older) {
+			c.skip(SkippedTime, p)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// filterPath returns whether rel, a slash separated path relative to the
+// source's root, should be archived.
+func (c *Car) filterPath(rel string, isDir bool) (bool, error) {
+	// the include filters only apply to files
+	if !isDir {
+		if !c.included(rel) {
+			return false, nil
+		}
+		b, err := c.includeFile(rel)
+		if err != nil || !b {
+			return false, err
+		}
+	}
+	b, err := c.excludeFile(rel)
 	if err != nil {
 		return false, err
 	}
@@ -180,16 +643,22 @@ func (c *Car) filterPath(root, p string) (bool, error) {
 	return true, nil
 }
 
-func (c *Car) includeFile(root, p string) (bool, error) {
+// includeFile returns whether p, a slash separated path relative to the
+// source's root, matches the IncludeAnchored prefix, the Include pattern,
+// or the IncludeExt extensions; if none of them are set, every file is
+// included.
+func (c *Car) includeFile(p string) (bool, error) {
+	if c.IncludeAnchored == "" && c.Include == "" && c.IncludeExtCount == 0 {
+		return true, nil
+	}
 	if c.IncludeAnchored != "" {
-		if strings.HasPrefix(filepath.Base(c.IncludeAnchored), p) {
+		if strings.HasPrefix(filepath.Base(p), c.IncludeAnchored) {
 			return true, nil
 		}
 	}
-	// since we are just evaluating a file, we use match and look at the
-	// fullpath
+	// the pattern is matched against the path relative to the source's root
 	if c.Include != "" {
-		matches, err := filepath.Match(c.Include, filepath.Join(root, p))
+		matches, err := filepath.Match(c.Include, filepath.FromSlash(p))
 		if err != nil {
 			return false, err
 		}
@@ -204,21 +673,19 @@ func (c *Car) includeFile(root, p string) (bool, error) {
 				return true, nil
 			}
 		}
-		return false, nil
 	}
-	return true, nil
+	return false, nil
 }
 
-func (c *Car) excludeFile(root, p string) (bool, error) {
+func (c *Car) excludeFile(p string) (bool, error) {
 	if c.ExcludeAnchored != "" {
 		if strings.HasPrefix(filepath.Base(p), c.ExcludeAnchored) {
 			return true, nil
 		}
 	}
-	// since we are just evaluating a file, we use match and look at the
-	// fullpath
+	// the pattern is matched against the path relative to the source's root
 	if c.Exclude != "" {
-		matches, err := filepath.Match(c.Exclude, filepath.Join(root, p))
+		matches, err := filepath.Match(c.Exclude, filepath.FromSlash(p))
 		if err != nil {
 			return false, err
 		}
@@ -241,31 +708,103 @@ func (c *Car) excludeFile(root, p string) (bool, error) {
 // the destination directory of the output, if a location other than the CWD
 // is desired. The source file can be a zip, tar, or compressed tar.
 func Extract(dst, src string) error {
+	return extract(nil, dst, src, nil)
+}
+
+// ExtractVerified extracts a signed source file. Before anything is
+// extracted, src is verified against its detached signature using key; if
+// the verification fails, an error is returned. See Extract.
+func ExtractVerified(dst, src string, key ed25519.PublicKey) error {
+	return extract(nil, dst, src, key)
+}
+
+// extract extracts src to dst; if ctx isn't nil, the extraction stops when it
+// is done.
+func extract(ctx context.Context, dst, src string, key ed25519.PublicKey) (err error) {
 	// determine the type of archive
 	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	if key != nil {
+		err = verifySignature(f, src, key)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	// encrypted tarballs need a passphrase or key, see Tar.
+	encrypted, err := IsEncrypted(f)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		return fmt.Errorf("%s: %w; a passphrase or key is required to extract it", src, ErrEncrypted)
+	}
 	// find its format
 	format, err := magicnum.GetFormat(f)
 	if err != nil {
 		return err
 	}
 	if !IsSupported(format) {
-		return fmt.Errorf("%s: %s is not a supported format", src, format)
+		return fmt.Errorf("%s: %s: %w", src, format, ErrUnsupportedFormat)
 	}
 	if format == magicnum.Zip {
-		// close the file, the zip reader will open it
-		f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
 		zip := NewZip(src)
 		zip.OutDir = dst
-		return zip.Extract()
+		if ctx != nil {
+			zip.ctx = ctx
+			defer func() { zip.endExtract(err) }()
+		}
+		return zip.ctxError(zip.ExtractReaderAt(f, fi.Size()))
 	}
-	defer f.Close()
 	tar := NewTar(src)
 	tar.OutDir = dst
 	tar.Format = format
-	return tar.ExtractArchive(f)
+	if ctx != nil {
+		tar.ctx = ctx
+		defer func() { tar.endExtract(err) }()
+	}
+	return tar.ctxError(tar.ExtractArchive(f))
+}
+
+// ExtractReader extracts the archive read from r, e.g. stdin or an HTTP
+// body. Dst is the destination directory of the output, if a location other
+// than the CWD is desired. The archive can be a zip, tar, or compressed tar;
+// zips are extracted as they are streamed, see Zip.ExtractReader.
+func ExtractReader(dst string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if bytes.HasPrefix(b, []byte(cryptMagic)) {
+		return fmt.Errorf("%w; a passphrase or key is required to extract it", ErrEncrypted)
+	}
+	format, err := magicnum.GetFormat(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if !IsSupported(format) {
+		return fmt.Errorf("%s: %w", format, ErrUnsupportedFormat)
+	}
+	if format == magicnum.Zip {
+		zip := NewZip("")
+		zip.OutDir = dst
+		return zip.ExtractReader(br)
+	}
+	tar := NewTar("")
+	tar.OutDir = dst
+	tar.Format = format
+	return tar.ExtractArchive(br)
 }
 
 //func formattedNow() string {
@@ -286,9 +825,7 @@ func getFileParts(s string) (dir, filename, ext string, err error) {
 		filename = parts[0]
 		return dir, filename, "", nil
 	case 0:
-		err := fmt.Errorf("no destination filename found in %s", s)
-		log.Print(err)
-		return dir, "", "", err
+		return dir, "", "", fmt.Errorf("no destination filename found in %s", s)
 	default:
 		// join all but the last parts together with a "."
 		filename = strings.Join(parts[0:l-1], ".")
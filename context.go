@@ -0,0 +1,172 @@
+package carchivum
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CreateContext is like Create but stops when ctx is done: the walk is
+// canceled, the queued files are closed, the partial archive is removed,
+// and ctx.Err() is returned.
+func (t *Tar) CreateContext(ctx context.Context, src ...string) (cnt int, err error) {
+	t.ctx = ctx
+	defer func() { t.ctx = nil }()
+	cnt, err = t.Create(src...)
+	return cnt, t.ctxError(err)
+}
+
+// CreateToContext is like CreateTo but stops when ctx is done, see
+// CreateContext. What has been written to w is not undone.
+func (t *Tar) CreateToContext(ctx context.Context, w io.Writer, src ...string) (cnt int, err error) {
+	t.ctx = ctx
+	defer func() { t.ctx = nil }()
+	cnt, err = t.CreateTo(w, src...)
+	return cnt, t.ctxError(err)
+}
+
+// ExtractContext is like Extract but stops when ctx is done: the files that
+// have been extracted are removed, the existing files that were backed up,
+// see BackupExisting, are restored, and ctx.Err() is returned.
+func (t *Tar) ExtractContext(ctx context.Context) (err error) {
+	t.ctx = ctx
+	defer func() { t.endExtract(err) }()
+	return t.ctxError(t.Extract())
+}
+
+// ExtractArchiveContext is like ExtractArchive but stops when ctx is done,
+// see ExtractContext.
+func (t *Tar) ExtractArchiveContext(ctx context.Context, src io.Reader) (err error) {
+	t.ctx = ctx
+	defer func() { t.endExtract(err) }()
+	return t.ctxError(t.ExtractArchive(src))
+}
+
+// CreateContext is like Create but stops when ctx is done: the walk is
+// canceled, the queued files are closed, the partial archive is removed,
+// and ctx.Err() is returned.
+func (z *Zip) CreateContext(ctx context.Context, src ...string) (cnt int, err error) {
+	z.ctx = ctx
+	defer func() { z.ctx = nil }()
+	cnt, err = z.Create(src...)
+	return cnt, z.ctxError(err)
+}
+
+// CreateToContext is like CreateTo but stops when ctx is done, see
+// CreateContext. What has been written to w is not undone.
+func (z *Zip) CreateToContext(ctx context.Context, w io.Writer, src ...string) (cnt int, err error) {
+	z.ctx = ctx
+	defer func() { z.ctx = nil }()
+	cnt, err = z.CreateTo(w, src...)
+	return cnt, z.ctxError(err)
+}
+
+// ExtractContext is like Extract but stops when ctx is done, see
+// Tar.ExtractContext.
+func (z *Zip) ExtractContext(ctx context.Context) (err error) {
+	z.ctx = ctx
+	defer func() { z.endExtract(err) }()
+	return z.ctxError(z.Extract())
+}
+
+// ExtractContext is like Extract but stops when ctx is done, see
+// Tar.ExtractContext.
+func ExtractContext(ctx context.Context, dst, src string) error {
+	return extract(ctx, dst, src, nil)
+}
+
+// ctxErr returns the context's error, if there is a context and it is done.
+func (c *Car) ctxErr() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// ctxError returns the context's error, instead of err, if the context is
+// done; err is usually a consequence of the cancelation.
+func (c *Car) ctxError(err error) error {
+	if err != nil {
+		if cerr := c.ctxErr(); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// ctxReader returns r, or, if there is a context, a reader of r that stops
+// when it is done.
+func (c *Car) ctxReader(r io.Reader) io.Reader {
+	if c.ctx == nil {
+		return r
+	}
+	return &ctxReader{c.ctx, r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// mkdirAll is os.MkdirAll; if there is a context, the directories it creates
+// are recorded so that they can be removed if the extraction is canceled.
+func (c *Car) mkdirAll(dir string, perm os.FileMode) error {
+	if c.ctx == nil {
+		return os.MkdirAll(dir, perm)
+	}
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err := os.Lstat(d)
+		if err == nil || !os.IsNotExist(err) || d == filepath.Dir(d) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	err := os.MkdirAll(dir, perm)
+	for i := len(missing) - 1; i >= 0; i-- {
+		c.extracted = append(c.extracted, missing[i])
+	}
+	return err
+}
+
+// extractedFile records a file that was extracted, if there is a context.
+func (c *Car) extractedFile(name string) {
+	if c.ctx != nil {
+		c.extracted = append(c.extracted, name)
+	}
+}
+
+// backedUp records an existing file, fname, that was renamed to backup, if
+// there is a context.
+func (c *Car) backedUp(fname, backup string) {
+	if c.ctx != nil {
+		c.backups = append(c.backups, [2]string{fname, backup})
+	}
+}
+
+// endExtract ends an extraction that returned err. If it was canceled, i.e.
+// err is the context's error, the extracted files, and the directories that
+// were created, are removed and the files that were backed up are restored.
+func (c *Car) endExtract(err error) {
+	if cerr := c.ctx.Err(); cerr != nil && errors.Is(err, cerr) {
+		for i := len(c.extracted) - 1; i >= 0; i-- {
+			os.Remove(c.extracted[i])
+		}
+		for i := len(c.backups) - 1; i >= 0; i-- {
+			os.Rename(c.backups[i][1], c.backups[i][0])
+		}
+	}
+	c.ctx = nil
+	c.extracted = nil
+	c.backups = nil
+}
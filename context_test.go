@@ -0,0 +1,143 @@
+package carchivum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// cancelReader cancels its context once n bytes have been read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n -= n
+	if r.n <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestContext(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// canceled before it starts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	_, err = newT.CreateContext(ctx, filepath.Join(tmpDir, "index"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	_, err = os.Stat(newT.Name)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the partial tarball to be removed, got %v", err)
+	}
+	// canceled while the files are being written
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	tests := []struct {
+		car    *Car
+		create func(ctx context.Context) (int, error)
+		name   string
+	}{
+		{&newT.Car, func(ctx context.Context) (int, error) { return newT.CreateContext(ctx, filepath.Join(tmpDir, "index")) }, newT.Name},
+		{&newZ.Car, func(ctx context.Context) (int, error) { return newZ.CreateContext(ctx, filepath.Join(tmpDir, "index")) }, newZ.Car.Name},
+	}
+	for _, test := range tests {
+		ctx, cancel = context.WithCancel(context.Background())
+		// the Hook is called concurrently
+		var n atomic.Int32
+		var once sync.Once
+		test.car.Hook = func(c *Candidate) (bool, error) {
+			if n.Add(1) >= 5 {
+				once.Do(cancel)
+			}
+			return true, nil
+		}
+		_, err = test.create(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected %v, got %v", test.name, context.Canceled, err)
+		}
+		_, err = os.Stat(test.name)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected the partial archive to be removed, got %v", test.name, err)
+		}
+		test.car.Hook = nil
+	}
+	// canceled while it is being extracted
+	var tgz bytes.Buffer
+	_, err = NewTar("").CreateTo(&tgz, filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	dst := filepath.Join(tmpDir, "out")
+	newT = NewTar("")
+	newT.OutDir = dst
+	err = newT.ExtractArchiveContext(ctx, &cancelReader{r: bytes.NewReader(tgz.Bytes()), n: tgz.Len() / 2, cancel: cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	_, err = os.Stat(dst)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the extracted files to be removed, got %v", err)
+	}
+	// not canceled
+	err = newT.ExtractArchiveContext(context.Background(), bytes.NewReader(tgz.Bytes()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, files[len(files)-1].name))
+	if err != nil || !bytes.Equal(b, files[len(files)-1].content) {
+		t.Errorf("Expected %s to be extracted, got %v", files[len(files)-1].name, err)
+	}
+	// canceled while existing files are being backed up; they are restored
+	first := filepath.Join(dst, files[0].name)
+	err = ioutil.WriteFile(first, []byte("existing"), 0644)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	newT.Overwrite = BackupExisting
+	err = newT.ExtractArchiveContext(ctx, &cancelReader{r: bytes.NewReader(tgz.Bytes()), n: tgz.Len() / 2, cancel: cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	b, err = ioutil.ReadFile(first)
+	if err != nil || string(b) != "existing" {
+		t.Errorf("Expected %s to be restored, got %q, %v", files[0].name, b, err)
+	}
+	_, err = os.Stat(first + ".~1~")
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the backup of %s to be restored, got %v", files[0].name, err)
+	}
+	// a context that is done after the extraction returned doesn't undo it
+	ctx, cancel = context.WithCancel(context.Background())
+	newT.ctx = ctx
+	newT.extractedFile(first)
+	cancel()
+	newT.endExtract(nil)
+	_, err = os.Stat(first)
+	if err != nil {
+		t.Errorf("Expected %s to be kept, got %v", files[0].name, err)
+	}
+}
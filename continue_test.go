@@ -0,0 +1,150 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// failFS fails to open the file named name.
+type failFS struct {
+	fs.FS
+	name string
+}
+
+func (f failFS) Open(name string) (fs.File, error) {
+	if name == f.name {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.FS.Open(name)
+}
+
+func TestContinueOnErrorCreate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	fsys := failFS{fstest.MapFS{
+		"src/a.txt": {Data: []byte("a")},
+		"src/b.txt": {Data: []byte("b")},
+		"src/c.txt": {Data: []byte("c")},
+	}, "src/b.txt"}
+	for _, reproducible := range []bool{false, true} {
+		newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+		newT.Reproducible = reproducible
+		_, err = newT.CreateFS(fsys, "src")
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("reproducible %t: expected %v, got %v", reproducible, fs.ErrPermission, err)
+		}
+		_, err = os.Stat(newT.Name)
+		if !os.IsNotExist(err) {
+			t.Errorf("reproducible %t: expected the tarball to be removed, got %v", reproducible, err)
+		}
+		newT.ContinueOnError = true
+		cnt, err := newT.CreateFS(fsys, "src")
+		var partial *PartialError
+		if !errors.As(err, &partial) || len(partial.Errs) != 1 || !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("reproducible %t: expected a partial error for src/b.txt, got %v", reproducible, err)
+			continue
+		}
+		if cnt != 2 {
+			t.Errorf("reproducible %t: expected 2 files, got %d", reproducible, cnt)
+		}
+		s := newT.Stats()
+		if s.Files != 2 || s.Skipped[SkippedFailed] != 1 {
+			t.Errorf("reproducible %t: expected 2 files and 1 failure, got %d and %v", reproducible, s.Files, s.Skipped)
+		}
+		newT.OutDir = filepath.Join(tmpDir, "out")
+		err = newT.Extract()
+		if err != nil {
+			t.Errorf("reproducible %t: expected error to be nil, got %q", reproducible, err)
+			continue
+		}
+		for _, name := range []string{"a.txt", "c.txt"} {
+			_, err = os.Stat(filepath.Join(newT.OutDir, "src", name))
+			if err != nil {
+				t.Errorf("reproducible %t: expected %s to be archived, got %v", reproducible, name, err)
+			}
+		}
+		os.RemoveAll(newT.OutDir)
+	}
+}
+
+func TestContinueOnErrorExtract(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// a tarball with an unsafe entry
+	var b bytes.Buffer
+	err = writeTestTar(&b, []testFile{{name: "../evil.txt", content: []byte("evil")}, {name: "good.txt", content: []byte("good")}})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newT := NewTar("")
+	newT.OutDir = filepath.Join(tmpDir, "tar")
+	newT.ContinueOnError = true
+	err = newT.ExtractTar(bytes.NewReader(b.Bytes()))
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Expected a partial unsafe path error, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(newT.OutDir, "good.txt"))
+	if err != nil {
+		t.Errorf("Expected good.txt to be extracted, got %v", err)
+	}
+	// a zip with an entry whose checksum doesn't match
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for _, f := range []testFile{{name: "bad.txt", content: []byte("bad")}, {name: "good.txt", content: []byte("good")}} {
+		crc := crc32.ChecksumIEEE(f.content)
+		if f.name == "bad.txt" {
+			crc++
+		}
+		w, err := zw.CreateRaw(&zip.FileHeader{Name: f.name, Method: zip.Store, CRC32: crc, CompressedSize64: uint64(len(f.content)), UncompressedSize64: uint64(len(f.content))})
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		w.Write(f.content)
+	}
+	zw.Close()
+	for _, streamed := range []bool{false, true} {
+		newZ := NewZip("")
+		newZ.OutDir = filepath.Join(tmpDir, "zip")
+		err = newZ.ExtractReaderAt(bytes.NewReader(zb.Bytes()), int64(zb.Len()))
+		if streamed {
+			err = newZ.ExtractReader(bytes.NewReader(zb.Bytes()))
+		}
+		if !errors.Is(err, zip.ErrChecksum) {
+			t.Errorf("streamed %t: expected %v, got %v", streamed, zip.ErrChecksum, err)
+		}
+		os.RemoveAll(newZ.OutDir)
+		newZ.ContinueOnError = true
+		if streamed {
+			err = newZ.ExtractReader(bytes.NewReader(zb.Bytes()))
+		} else {
+			err = newZ.ExtractReaderAt(bytes.NewReader(zb.Bytes()), int64(zb.Len()))
+		}
+		var partial *PartialError
+		if !errors.As(err, &partial) || !errors.Is(err, ErrCorrupt) {
+			t.Errorf("streamed %t: expected a partial corrupt entry error, got %v", streamed, err)
+		}
+		_, err = os.Stat(filepath.Join(newZ.OutDir, "good.txt"))
+		if err != nil {
+			t.Errorf("streamed %t: expected good.txt to be extracted, got %v", streamed, err)
+		}
+		os.RemoveAll(newZ.OutDir)
+	}
+}
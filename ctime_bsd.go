@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+
+package carchivum
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns the status change time of the file, or its
+// modification time if it isn't available.
+func changeTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Ctimespec.Sec), int64(st.Ctimespec.Nsec))
+}
@@ -0,0 +1,19 @@
+//go:build linux || openbsd || dragonfly || solaris
+
+package carchivum
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns the status change time of the file, or its
+// modification time if it isn't available.
+func changeTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+}
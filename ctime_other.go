@@ -0,0 +1,14 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !darwin && !freebsd && !netbsd
+
+package carchivum
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime returns the file's modification time as its status change time
+// isn't available.
+func changeTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,148 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	_ "crypto/md5" // register the hashes that can be used for digests
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// paxDigestPrefix is the vendor prefix of the PAX record that holds a tar
+// entry's digest, e.g. CARCHIVUM.sha256.
+const paxDigestPrefix = "CARCHIVUM."
+
+// zipDigestID is the id of the extra field that holds a zip entry's digest.
+// The field's data is the length of the hash name, the hash name, and the
+// raw digest.
+const zipDigestID = 0x4443
+
+// digestNames are the hashes that can be used for entry digests and the
+// names they are recorded under.
+var digestNames = map[crypto.Hash]string{
+	crypto.MD5:    "md5",
+	crypto.SHA1:   "sha1",
+	crypto.SHA256: "sha256",
+	crypto.SHA512: "sha512",
+}
+
+func digestName(h crypto.Hash) (string, error) {
+	name, ok := digestNames[h]
+	if !ok || !h.Available() {
+		return "", fmt.Errorf("%s is not a supported digest hash", h)
+	}
+	return name, nil
+}
+
+func digestHash(name string) (crypto.Hash, bool) {
+	for h, n := range digestNames {
+		if n == name {
+			return h, true
+		}
+	}
+	return 0, false
+}
+
+// fileDigest returns the digest of f's content. Once the digest has been
+// computed, f is rewound so that its content can be archived.
+func fileDigest(f io.ReadSeeker, h crypto.Hash) ([]byte, error) {
+	hw := h.New()
+	_, err := io.Copy(hw, f)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return hw.Sum(nil), nil
+}
+
+// zipDigestExtra returns the extra field that records the digest.
+func zipDigestExtra(h crypto.Hash, sum []byte) ([]byte, error) {
+	name, err := digestName(h)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4, 5+len(name)+len(sum))
+	binary.LittleEndian.PutUint16(b, zipDigestID)
+	binary.LittleEndian.PutUint16(b[2:], uint16(1+len(name)+len(sum)))
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	return append(b, sum...), nil
+}
+
+// verifier checks the content written to it against an expected digest.
+type verifier struct {
+	hash.Hash
+	name string
+	alg  string
+	sum  []byte
+}
+
+// verify returns an error if the content written to v does not match the
+// expected digest.
+func (v *verifier) verify() error {
+	if !bytes.Equal(v.Sum(nil), v.sum) {
+		return &CorruptError{Name: v.name, Offset: -1, Err: fmt.Errorf("%s digest mismatch", v.alg)}
+	}
+	return nil
+}
+
+// tarVerifier returns a verifier for the digest recorded in hdr's PAX
+// records. If hdr doesn't have a digest, a nil verifier is returned.
+func tarVerifier(hdr *tar.Header) (*verifier, error) {
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxDigestPrefix) {
+			continue
+		}
+		alg := strings.TrimPrefix(k, paxDigestPrefix)
+		h, ok := digestHash(alg)
+		if !ok || !h.Available() {
+			return nil, fmt.Errorf("%s: %s is not a supported digest hash", hdr.Name, alg)
+		}
+		sum, err := hex.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s digest: %s", hdr.Name, alg, err)
+		}
+		return &verifier{Hash: h.New(), name: hdr.Name, alg: alg, sum: sum}, nil
+	}
+	return nil, nil
+}
+
+// zipVerifier returns a verifier for the digest recorded in the extra field
+// of the named entry. If extra doesn't have a digest, a nil verifier is
+// returned.
+func zipVerifier(name string, extra []byte) (*verifier, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		data := extra[:size]
+		extra = extra[size:]
+		if id != zipDigestID {
+			continue
+		}
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, fmt.Errorf("%s: invalid digest field", name)
+		}
+		alg := string(data[1 : 1+data[0]])
+		h, ok := digestHash(alg)
+		if !ok || !h.Available() {
+			return nil, fmt.Errorf("%s: %s is not a supported digest hash", name, alg)
+		}
+		return &verifier{Hash: h.New(), name: name, alg: alg, sum: data[1+data[0]:]}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,112 @@
+package carchivum
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedFormat is the error, possibly wrapped, for formats, and
+	// compression algorithms, that aren't supported.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrUnsafePath is the error of the fs.PathError for an entry that
+	// would be extracted outside of the OutDir, e.g. "../x", or through a
+	// symlink, or for a symlink that points outside of it; see safePath.
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrLimitExceeded is the error, possibly wrapped, for archives that
+	// exceed a limit of their format.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrEncrypted is the error, possibly wrapped, for an encrypted tarball
+	// that is extracted without a passphrase or key.
+	ErrEncrypted = errors.New("tarball is encrypted")
+	// ErrCorrupt is matched by a CorruptError.
+	ErrCorrupt = errors.New("corrupt entry")
+)
+
+// CorruptError is an entry of an archive that is corrupt, e.g. its checksum,
+// or digest, doesn't match or its header is invalid. Name is the entry's
+// name, if it is known, and Offset is where, in the archive or in a
+// compressed tarball's tar stream, the corruption was found, or -1 if that
+// isn't known.
+type CorruptError struct {
+	Name   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	s := e.Err.Error()
+	if e.Offset >= 0 {
+		s = fmt.Sprintf("offset %d: %s", e.Offset, s)
+	}
+	if e.Name != "" {
+		s = e.Name + ": " + s
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether target is ErrCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// PartialError is returned when an operation completes but some of its
+// files failed; Errs are their errors. It matches, with errors.Is and
+// errors.As, each of them.
+type PartialError struct {
+	Errs []error
+}
+
+func (e *PartialError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+	s := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		s[i] = err.Error()
+	}
+	return fmt.Sprintf("%d files failed: %s", len(e.Errs), strings.Join(s, "; "))
+}
+
+// Unwrap returns the errors.
+func (e *PartialError) Unwrap() []error {
+	return e.Errs
+}
+
+// failed records err, the error of the file, or entry, p, and returns nil if
+// ContinueOnError is set; otherwise, or if the context is done, err is
+// returned. It is safe to call concurrently.
+func (c *Car) failed(p string, err error) error {
+	if !c.ContinueOnError || c.ctxErr() != nil {
+		return err
+	}
+	// the files that fail while the sources are scanned fail again.
+	if c.progress.scanning {
+		return nil
+	}
+	if c.Logger != nil {
+		c.Logger.Warn("skipped", "path", p, "reason", string(SkippedFailed), "err", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats.Skipped == nil {
+		c.stats.Skipped = map[SkipReason]int{}
+	}
+	c.stats.Skipped[SkippedFailed]++
+	c.failures = append(c.failures, err)
+	return nil
+}
+
+// partial returns a *PartialError of the failures, if there are any.
+func (c *Car) partial() error {
+	if len(c.failures) == 0 {
+		return nil
+	}
+	return &PartialError{Errs: c.failures}
+}
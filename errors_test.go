@@ -0,0 +1,93 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	magicnum "github.com/mohae/magicnum/compress"
+)
+
+func TestErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newT := NewTar(filepath.Join(tmpDir, "test.tar"))
+	newT.OutDir = filepath.Join(tmpDir, "out")
+	// unsafe paths
+	var b bytes.Buffer
+	err = writeTestTar(&b, []testFile{{name: "../evil.txt", content: []byte("evil")}})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = newT.ExtractTar(&b)
+	var perr *fs.PathError
+	if !errors.Is(err, ErrUnsafePath) || !errors.As(err, &perr) || perr.Path != "../evil.txt" {
+		t.Errorf("Expected an unsafe path error for ../evil.txt, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "evil.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected evil.txt not to be extracted, got %v", err)
+	}
+	b.Reset()
+	tw := tar.NewWriter(&b)
+	tw.WriteHeader(&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777})
+	tw.Close()
+	err = newT.ExtractTar(&b)
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Expected an unsafe path error for a symlink to /etc/passwd, got %v", err)
+	}
+	// a corrupt tarball
+	err = newT.ExtractTar(bytes.NewReader(bytes.Repeat([]byte("x"), 1024)))
+	var cerr *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &cerr) || cerr.Offset < 0 {
+		t.Errorf("Expected a corrupt entry error with an offset, got %v", err)
+	}
+	if !errors.Is(err, tar.ErrHeader) {
+		t.Errorf("Expected %v to wrap %v", err, tar.ErrHeader)
+	}
+	// a truncated tarball
+	b.Reset()
+	err = writeTestTar(&b, []testFile{{name: "a.txt", content: []byte("content")}})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = newT.ExtractTar(bytes.NewReader(b.Bytes()[:100]))
+	if !errors.Is(err, ErrCorrupt) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a corrupt entry error for %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	// the source's errors aren't corrupt entries
+	readErr := errors.New("read error")
+	err = newT.ExtractTar(io.MultiReader(bytes.NewReader(b.Bytes()[:100]), iotest.ErrReader(readErr)))
+	if !errors.Is(err, readErr) || errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected %v, got %v", readErr, err)
+	}
+	// unsupported formats
+	newT.Format = magicnum.BZip2
+	_, err = newT.CreateTo(ioutil.Discard, tmpDir)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected an unsupported format error, got %v", err)
+	}
+	// partial failures
+	err = &PartialError{Errs: []error{fmt.Errorf("a: %w", os.ErrNotExist), &CorruptError{Name: "b", Offset: 512, Err: tar.ErrHeader}}}
+	if !errors.Is(err, os.ErrNotExist) || !errors.Is(err, ErrCorrupt) || !errors.As(err, &cerr) || cerr.Name != "b" {
+		t.Errorf("Expected the partial error to match its errors, got %v", err)
+	}
+	expected := "2 files failed: a: file does not exist; b: offset 512: archive/tar: invalid tar header"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err)
+	}
+}
@@ -0,0 +1,480 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	magicnum "github.com/mohae/magicnum/compress"
+	"github.com/pierrec/lz4"
+)
+
+// ZipFS is a read-only fs.FS of a zip archive's content. It implements
+// fs.ReadDirFS and fs.StatFS, so it can be used with fs.WalkDir,
+// http.FS, template.ParseFS, etc. Encrypted entries can't be opened: Open
+// returns an fs.ErrPermission error for them.
+type ZipFS struct {
+	r *zip.Reader
+	c io.Closer
+	// the names of the encrypted entries.
+	encrypted map[string]bool
+}
+
+// OpenZipFS opens the named zip archive as a ZipFS. The ZipFS must be
+// closed when it is no longer needed.
+func OpenZipFS(name string) (*ZipFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	z, err := NewZipFS(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	z.c = f
+	return z, nil
+}
+
+// NewZipFS returns a ZipFS of the zip archive, of size bytes, read from r.
+func NewZipFS(r io.ReaderAt, size int64) (*ZipFS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	(&Zip{}).registerDecompressors(zr)
+	z := &ZipFS{r: zr}
+	for _, f := range zr.File {
+		if f.Flags&zipEncrypted != 0 || f.Method == aesMethod {
+			if z.encrypted == nil {
+				z.encrypted = map[string]bool{}
+			}
+			z.encrypted[path.Clean(strings.TrimPrefix(f.Name, "/"))] = true
+		}
+	}
+	return z, nil
+}
+
+// Open opens the named file.
+func (z *ZipFS) Open(name string) (fs.File, error) {
+	if z.encrypted[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return z.r.Open(name)
+}
+
+// ReadDir reads the named directory and returns its entries sorted by
+// filename.
+func (z *ZipFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(z.r, name)
+}
+
+// Stat returns the FileInfo of the named file.
+func (z *ZipFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(z.r, name)
+}
+
+// Close closes the zip archive if it was opened by OpenZipFS.
+func (z *ZipFS) Close() error {
+	if z.c == nil {
+		return nil
+	}
+	return z.c.Close()
+}
+
+// TarFS is a read-only fs.FS of a tar, or compressed tar, archive's content.
+// It implements fs.ReadDirFS and fs.StatFS. The archive is indexed when it
+// is opened. The files of an uncompressed tar are read directly from the
+// archive; the files of a compressed tar are read by decompressing the
+// archive up to the file, so opening them is slower the further they are in
+// the archive.
+type TarFS struct {
+	r       io.ReaderAt
+	size    int64
+	format  magicnum.Format
+	entries map[string]*tarEntry
+	c       io.Closer
+}
+
+// tarEntry is an indexed file in a TarFS. Offset is the offset of the file's
+// content in the uncompressed tar.
+type tarEntry struct {
+	name     string
+	info     fs.FileInfo
+	offset   int64
+	children []string
+}
+
+// OpenTarFS opens the named tar, or compressed tar, as a TarFS. The TarFS
+// must be closed when it is no longer needed.
+func OpenTarFS(name string) (*TarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t, err := NewTarFS(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.c = f
+	return t, nil
+}
+
+// NewTarFS returns a TarFS of the tar, or compressed tar, archive, of size
+// bytes, read from r.
+func NewTarFS(r io.ReaderAt, size int64) (*TarFS, error) {
+	encrypted, err := IsEncrypted(r)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return nil, fmt.Errorf("encrypted tarballs: %w", ErrUnsupportedFormat)
+	}
+	format, err := magicnum.GetFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	t := &TarFS{r: r, size: size, format: format, entries: map[string]*tarEntry{}}
+	t.entries["."] = &tarEntry{name: ".", info: dirInfo(".")}
+	err = t.index()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.entries {
+		sort.Strings(e.children)
+	}
+	return t, nil
+}
+
+// decompress returns a reader of the uncompressed tar of a tarball that is
+// compressed using format.
+func decompress(r io.Reader, format magicnum.Format) (io.ReadCloser, error) {
+	switch format {
+	case magicnum.Tar:
+		return io.NopCloser(r), nil
+	case magicnum.GZip:
+		return gzip.NewReader(r)
+	case magicnum.BZip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case magicnum.LZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("%s: %w", format, ErrUnsupportedFormat)
+}
+
+// index reads the tar's headers and records each file's offset.
+func (t *TarFS) index() error {
+	rc, err := decompress(io.NewSectionReader(t.r, 0, t.size), t.format)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	cr := &countReader{r: bufio.NewReader(rc)}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		name := strings.TrimSuffix(path.Clean(strings.TrimLeft(hdr.Name, "/")), "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		// tar.Reader has read the header, but none of the content, so the
+		// count is the content's offset.
+		t.add(name, hdr.FileInfo(), cr.n)
+	}
+}
+
+// add adds the named file, and any of its parent directories that aren't in
+// the index, to the index.
+func (t *TarFS) add(name string, info fs.FileInfo, offset int64) {
+	e, ok := t.entries[name]
+	if ok {
+		// a later entry replaces an earlier one, except that a directory
+		// keeps its children.
+		e.info = info
+		e.offset = offset
+		return
+	}
+	t.entries[name] = &tarEntry{name: name, info: info, offset: offset}
+	dir := path.Dir(name)
+	if _, ok := t.entries[dir]; !ok {
+		t.add(dir, dirInfo(path.Base(dir)), 0)
+	}
+	t.entries[dir].children = append(t.entries[dir].children, name)
+}
+
+// Open opens the named file.
+func (t *TarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return &tarDir{fs: t, e: e}, nil
+	}
+	return &tarFile{fs: t, e: e}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by
+// filename.
+func (t *TarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	return t.dirEntries(e), nil
+}
+
+// Stat returns the FileInfo of the named file.
+func (t *TarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+// Close closes the archive if it was opened by OpenTarFS.
+func (t *TarFS) Close() error {
+	if t.c == nil {
+		return nil
+	}
+	return t.c.Close()
+}
+
+func (t *TarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t *TarFS) dirEntries(e *tarEntry) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, c := range e.children {
+		entries[i] = fs.FileInfoToDirEntry(t.entries[c].info)
+	}
+	return entries
+}
+
+// tarFile is an open file in a TarFS.
+type tarFile struct {
+	fs  *TarFS
+	e   *tarEntry
+	pos int64
+	// the open reader of the content and its position
+	rc   io.ReadCloser
+	r    io.Reader
+	rpos int64
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.e.info, nil
+}
+
+func (f *tarFile) Read(p []byte) (int, error) {
+	size := f.e.info.Size()
+	if f.pos >= size {
+		return 0, io.EOF
+	}
+	if f.r == nil || f.rpos != f.pos {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.rpos = f.pos
+	if err == io.EOF && f.pos < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open opens a reader of the file's content at pos.
+func (f *tarFile) open() error {
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	size := f.e.info.Size()
+	if f.fs.format == magicnum.Tar {
+		f.r = io.NewSectionReader(f.fs.r, f.e.offset+f.pos, size-f.pos)
+		f.rpos = f.pos
+		return nil
+	}
+	rc, err := decompress(io.NewSectionReader(f.fs.r, 0, f.fs.size), f.fs.format)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.Discard, rc, f.e.offset+f.pos)
+	if err != nil {
+		rc.Close()
+		return err
+	}
+	f.rc = rc
+	f.r = io.LimitReader(rc, size-f.pos)
+	f.rpos = f.pos
+	return nil
+}
+
+// Seek sets the offset of the next Read. Seeking in a file of a compressed
+// tar is done by decompressing the archive up to the new offset on the next
+// Read.
+func (f *tarFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.e.info.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.e.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.e.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *tarFile) Close() error {
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
+
+// tarDir is an open directory in a TarFS.
+type tarDir struct {
+	fs      *TarFS
+	e       *tarEntry
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) {
+	return d.e.info, nil
+}
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.entries = d.fs.dirEntries(d.e)
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *tarDir) Close() error {
+	return nil
+}
+
+// dirInfo is the FileInfo of a directory that is implied by the paths of a
+// tar's files but doesn't have its own entry.
+type dirInfo string
+
+func (d dirInfo) Name() string       { return string(d) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
+
+// CreateFS creates a tarball, saved to the Tar's Name, from the src('s) in
+// fsys, e.g. an embed.FS, an fstest.MapFS, or another archive's FS. The
+// files are named by their path in fsys; if there aren't any sources, all of
+// fsys is archived. DeleteArchived doesn't apply to files in an fs.FS.
+func (t *Tar) CreateFS(fsys fs.FS, src ...string) (cnt int, err error) {
+	t.fsys = fsys
+	defer func() { t.fsys = nil }()
+	if len(src) == 0 {
+		src = []string{"."}
+	}
+	return t.Create(src...)
+}
+
+// CreateFSTo creates a compressed tarball from the src('s) in fsys and writes
+// it to w as it is created. See CreateFS.
+func (t *Tar) CreateFSTo(w io.Writer, fsys fs.FS, src ...string) (cnt int, err error) {
+	t.fsys = fsys
+	defer func() { t.fsys = nil }()
+	if len(src) == 0 {
+		src = []string{"."}
+	}
+	return t.CreateTo(w, src...)
+}
+
+// CreateFS creates a zip, saved to the Zip's Name, from the src('s) in fsys,
+// e.g. an embed.FS, an fstest.MapFS, or another archive's FS. The files are
+// named by their path in fsys; if there aren't any sources, all of fsys is
+// archived.
+func (z *Zip) CreateFS(fsys fs.FS, src ...string) (cnt int, err error) {
+	z.fsys = fsys
+	defer func() { z.fsys = nil }()
+	if len(src) == 0 {
+		src = []string{"."}
+	}
+	return z.Create(src...)
+}
+
+// CreateFSTo creates a zip from the src('s) in fsys and writes it to w as it
+// is created. See CreateFS.
+func (z *Zip) CreateFSTo(w io.Writer, fsys fs.FS, src ...string) (cnt int, err error) {
+	z.fsys = fsys
+	defer func() { z.fsys = nil }()
+	if len(src) == 0 {
+		src = []string{"."}
+	}
+	return z.CreateTo(w, src...)
+}
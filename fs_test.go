@@ -0,0 +1,198 @@
+package carchivum
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestArchiveFS(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var tgz, tb, zipped bytes.Buffer
+	_, err = NewTar("").CreateTo(&tgz, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// an uncompressed tar
+	newT := NewTar("")
+	newT.sources = []string{filepath.Join(tmpDir, "test")}
+	err = newT.writeTar(&tb)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	_, err = NewZip("").CreateTo(&zipped, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tgzFS, err := NewTarFS(bytes.NewReader(tgz.Bytes()), int64(tgz.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tarFS, err := NewTarFS(bytes.NewReader(tb.Bytes()), int64(tb.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	zipFS, err := NewZipFS(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tests := []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"tgz", tgzFS},
+		{"tar", tarFS},
+		{"zip", zipFS},
+	}
+	for _, test := range tests {
+		err = fstest.TestFS(test.fsys, "test/test1.txt", "test/test2.txt", "test/dir/test1.txt", "test/dir/test2.txt")
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+		}
+		for _, f := range TestFiles {
+			b, err := fs.ReadFile(test.fsys, f.name)
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+				continue
+			}
+			if !bytes.Equal(b, f.content) {
+				t.Errorf("%s: expected %q, got %q", test.name, f.content, b)
+			}
+		}
+		var n int
+		err = fs.WalkDir(test.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+		}
+		if n != 4 {
+			t.Errorf("%s: expected to walk 4 files, got %d", test.name, n)
+		}
+	}
+}
+
+func TestZipFSEncrypted(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var zipped bytes.Buffer
+	newZ := NewZip("")
+	newZ.PasswordFunc = func(name string) (string, error) {
+		if name == "test/test1.txt" {
+			return "secret", nil
+		}
+		return "", nil
+	}
+	_, err = newZ.CreateTo(&zipped, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	zipFS, err := NewZipFS(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	_, err = zipFS.Open("test/test1.txt")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected %v, got %v", fs.ErrPermission, err)
+	}
+	b, err := fs.ReadFile(zipFS, "test/test2.txt")
+	if err != nil || string(b) != "some more content\n" {
+		t.Errorf("Expected test/test2.txt to be read, got %q, %v", b, err)
+	}
+}
+
+func TestCreateFS(t *testing.T) {
+	initTestFiles()
+	mapFS := fstest.MapFS{}
+	for _, f := range TestFiles {
+		mapFS[f.name] = &fstest.MapFile{Data: f.content, Mode: 0644}
+	}
+	mapFS["other.txt"] = &fstest.MapFile{Data: []byte("not archived\n"), Mode: 0644}
+	var tgz, zipped bytes.Buffer
+	newT := NewTar("")
+	newT.Hash = crypto.SHA256
+	cnt, err := newT.CreateFSTo(&tgz, mapFS, "test")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if cnt != 5 {
+		t.Errorf("Expected a count of 5; got %d", cnt)
+	}
+	tgzFS, err := NewTarFS(bytes.NewReader(tgz.Bytes()), int64(tgz.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// a zip from the tarball's FS, whose files aren't seekable, so they are
+	// spooled for their digests.
+	newZ := NewZip("")
+	newZ.Hash = crypto.SHA256
+	newZ.SniffCompressed = true
+	cnt, err = newZ.CreateFSTo(&zipped, tgzFS)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// the test dir is counted too
+	if cnt != 6 {
+		t.Errorf("Expected a count of 6; got %d", cnt)
+	}
+	zipFS, err := NewZipFS(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	for _, f := range TestFiles {
+		b, err := fs.ReadFile(zipFS, f.name)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			continue
+		}
+		if !bytes.Equal(b, f.content) {
+			t.Errorf("%s: expected %q, got %q", f.name, f.content, b)
+		}
+	}
+	_, err = fs.Stat(zipFS, "other.txt")
+	if err == nil {
+		t.Error("Expected other.txt to not be archived")
+	}
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newZ = NewZip("")
+	newZ.OutDir = tmpDir
+	newZ.VerifyDigests = true
+	err = newZ.ExtractReaderAt(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+	}
+}
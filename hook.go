@@ -0,0 +1,115 @@
+package carchivum
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Candidate is a file, or directory, that is about to be queued to be
+// archived; it is passed to the Car's Hook, which can change how it is
+// archived.
+type Candidate struct {
+	// Path is the file's path: an OS path, or its path in the fs.FS the
+	// archive is being created from.
+	Path string
+	Info os.FileInfo
+	// Name is the file's name in the archive; changing it renames the file
+	// in the archive. It can't be renamed to nothing, e.g. "" or "/".
+	Name string
+	// Mode, if set, are the permissions the file is archived with.
+	Mode os.FileMode
+	// ModTime, if set, is the modification time the file is archived with.
+	ModTime time.Time
+	// Uid and Gid, if >= 0, are the owner and group ids the file is
+	// archived with; they are -1 unless the Hook sets them. Zips don't
+	// store them.
+	Uid int
+	Gid int
+	// Content, if set, is called for the content to archive instead of the
+	// file's. The content is spooled to a temporary file to get its size.
+	Content func() (io.ReadCloser, error)
+}
+
+// callHook passes the file at p, named name in the archive, to the Hook. It
+// returns the entry to queue and how to open its content, or false if the
+// hook skips the file.
+func (c *Car) callHook(p, name string, fi os.FileInfo, open func() (fs.File, error)) (*entry, func() (fs.File, error), bool, error) {
+	cand := &Candidate{Path: p, Info: fi, Name: name, Uid: -1, Gid: -1}
+	ok, err := c.Hook(cand)
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+	if cand.Name != name && strings.Trim(path.Clean("/"+filepath.ToSlash(cand.Name)), "/") == "" {
+		return nil, nil, false, fmt.Errorf("%s: the Hook renamed it to %q", p, cand.Name)
+	}
+	e := &entry{Name: filepath.ToSlash(cand.Name), hook: cand}
+	if cand.Content != nil && !fi.IsDir() {
+		open = func() (fs.File, error) {
+			r, err := cand.Content()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return spool(r, fi)
+		}
+	}
+	return e, open, true, nil
+}
+
+// contentInfo returns the info of e's content: fi, the info of the file, or,
+// if the Hook substituted its content, that of the spooled content, whose
+// size differs.
+func (e *entry) contentInfo(fi os.FileInfo) (os.FileInfo, error) {
+	if e.hook == nil || e.hook.Content == nil || fi.IsDir() {
+		return fi, nil
+	}
+	return e.file.Stat()
+}
+
+// spool copies r to a temporary file, which is removed when it is closed.
+// Its FileInfo is fi with the content's size.
+func spool(r io.Reader, fi os.FileInfo) (fs.File, error) {
+	tmp, err := os.CreateTemp("", "carchivum")
+	if err != nil {
+		return nil, err
+	}
+	f := &spooledFile{File: tmp}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.info = sizedInfo{fi, n}
+	return f, nil
+}
+
+// spooledFile is a temporary file holding a file's substituted content.
+type spooledFile struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (f *spooledFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// sizedInfo is a FileInfo with a different size.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedInfo) Size() int64 { return fi.size }
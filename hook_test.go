@@ -0,0 +1,146 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHook(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	var buf bytes.Buffer
+	newT := NewTar("")
+	newT.Hash = crypto.SHA256
+	newT.VerifyDigests = true
+	newT.Hook = func(c *Candidate) (bool, error) {
+		if c.Info.IsDir() {
+			return true, nil
+		}
+		switch c.Name {
+		case "test/test2.txt":
+			return false, nil
+		case "test/dir/test1.txt":
+			c.Name = "test/renamed.txt"
+		case "test/test1.txt":
+			c.Mode = 0600
+			c.ModTime = mtime
+			c.Uid, c.Gid = 42, 43
+		case "test/dir/test2.txt":
+			c.Content = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("substituted content\n")), nil
+			}
+		}
+		return true, nil
+	}
+	_, err = newT.CreateTo(&buf, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	expected := map[string]string{
+		"test/test1.txt":     "some content\n",
+		"test/renamed.txt":   "different content\n",
+		"test/dir/test2.txt": "substituted content\n",
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(tr)
+		content, ok := expected[hdr.Name]
+		if !ok {
+			t.Errorf("Unexpected entry %s", hdr.Name)
+			continue
+		}
+		delete(expected, hdr.Name)
+		if string(b) != content {
+			t.Errorf("%s: expected %q, got %q", hdr.Name, content, b)
+		}
+		if hdr.Name == "test/test1.txt" {
+			if hdr.Mode != 0600 || !hdr.ModTime.Equal(mtime) || hdr.Uid != 42 || hdr.Gid != 43 {
+				t.Errorf("%s: unexpected header %o %v %d %d", hdr.Name, hdr.Mode, hdr.ModTime, hdr.Uid, hdr.Gid)
+			}
+		}
+	}
+	for name := range expected {
+		t.Errorf("Expected %s to be archived", name)
+	}
+	// the digest is of the substituted content
+	newT.OutDir = filepath.Join(tmpDir, "out")
+	err = newT.ExtractArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+	}
+	// the content the hook substitutes is counted instead of the file's
+	for _, reproducible := range []bool{false, true} {
+		newT := NewTar("")
+		newT.Reproducible = reproducible
+		_, err = newT.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "test"))
+		if err != nil {
+			t.Errorf("reproducible %t: expected error to be nil, got %q", reproducible, err)
+			continue
+		}
+		n := newT.bytes
+		newT.Hook = func(c *Candidate) (bool, error) {
+			if c.Name == "test/dir/test2.txt" {
+				c.Content = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("substituted content\n")), nil
+				}
+			}
+			return true, nil
+		}
+		_, err = newT.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "test"))
+		if err != nil {
+			t.Errorf("reproducible %t: expected error to be nil, got %q", reproducible, err)
+			continue
+		}
+		expected := n + int64(len("substituted content\n")-len("might be different content\n"))
+		if newT.bytes != expected {
+			t.Errorf("reproducible %t: expected %d bytes, got %d", reproducible, expected, newT.bytes)
+		}
+	}
+	// a file can't be renamed to nothing
+	newZ := NewZip("")
+	newZ.Hook = func(c *Candidate) (bool, error) {
+		c.Name = "/"
+		return true, nil
+	}
+	_, err = newZ.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "test"))
+	if err == nil || !strings.Contains(err.Error(), "renamed") {
+		t.Errorf("Expected an error for a file renamed to nothing, got %v", err)
+	}
+	// errors stop the archive's creation
+	newZ = NewZip("")
+	newZ.Hook = func(c *Candidate) (bool, error) {
+		return false, fmt.Errorf("rejected %s", c.Name)
+	}
+	_, err = newZ.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "test"))
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Expected the hook's error, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package carchivum
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// DefaultIgnoreFiles are the ignore files that are commonly used with
+// IgnoreFiles.
+var DefaultIgnoreFiles = []string{".gitignore", ".carignore"}
+
+// pattern is a gitignore pattern.
+type pattern struct {
+	// the directory, relative to the source root, the pattern is relative
+	// to; "." for the root.
+	base string
+	glob string
+	// negate re-includes what an earlier pattern excluded; dirOnly only
+	// matches directories; anchored patterns are matched against the path
+	// relative to base, others against any trailing part of it.
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parsePatterns parses gitignore patterns, one per line, that are relative
+// to base. Blank lines and comments are skipped.
+func parsePatterns(base string, b []byte) []pattern {
+	var ps []pattern
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		p, ok := parsePattern(base, s.Text())
+		if ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// parsePattern parses a gitignore pattern, see gitignore(5).
+func parsePattern(base, line string) (pattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return pattern{}, false
+	}
+	p := pattern{base: base}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+	// a pattern with a separator, other than a trailing one, is relative to
+	// base.
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.glob = line
+	return p, true
+}
+
+// match returns whether rel, a slash separated path relative to the source
+// root, matches the pattern.
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "." {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if p.anchored {
+		return matchGlob(p.glob, rel)
+	}
+	return matchGlob(p.glob, path.Base(rel))
+}
+
+// matchGlob returns whether name matches the glob, a path.Match pattern in
+// which a leading, or inner, "**" element matches zero or more path elements
+// and a trailing one matches one or more.
+func matchGlob(glob, name string) bool {
+	return matchElems(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			// collapse consecutive "**"
+			for len(glob) > 1 && glob[1] == "**" {
+				glob = glob[1:]
+			}
+			// a trailing "**" matches everything inside a directory, but
+			// not the directory.
+			if len(glob) == 1 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchElems(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(glob[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchPatterns returns whether rel matches the patterns; as with gitignore,
+// the last pattern that matches rel decides, so a negated pattern can
+// re-include what an earlier one matched.
+func matchPatterns(ps []pattern, rel string, isDir bool) bool {
+	var matched bool
+	for _, p := range ps {
+		if p.match(rel, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// readIgnoreFiles reads the IgnoreFiles, if any, in dir, a directory
+// relative to the current source's root; read reads a file in dir. The walk
+// can visit directories concurrently; a directory's ignore files are read
+// when it is visited, which is before its content is.
+func (c *Car) readIgnoreFiles(dir string, read func(name string) ([]byte, error)) error {
+	var ps []pattern
+	for _, name := range c.IgnoreFiles {
+		b, err := read(name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		ps = append(ps, parsePatterns(dir, b)...)
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	if c.ignores == nil {
+		c.ignores = map[string][]pattern{}
+	}
+	c.ignores[dir] = ps
+	c.mu.Unlock()
+	return nil
+}
+
+// ignored returns whether rel, a slash separated path relative to the
+// current source's root, is excluded by ExcludePatterns or the patterns in
+// the ignore files of its ancestors. Patterns in deeper ignore files take
+// precedence.
+func (c *Car) ignored(rel string, isDir bool) bool {
+	if len(c.excludePatterns) == 0 && len(c.IgnoreFiles) == 0 {
+		return false
+	}
+	ps := c.excludePatterns
+	c.mu.Lock()
+	var dirs []string
+	for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == "." {
+			break
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		ps = append(ps[:len(ps):len(ps)], c.ignores[dirs[i]]...)
+	}
+	c.mu.Unlock()
+	return matchPatterns(ps, rel, isDir)
+}
+
+// included returns whether rel, a file's slash separated path relative to
+// the current source's root, matches the IncludePatterns, if there are any.
+func (c *Car) included(rel string) bool {
+	if len(c.includePatterns) == 0 {
+		return true
+	}
+	if matchPatterns(c.includePatterns, rel, false) {
+		return true
+	}
+	// or is in a directory that matches them.
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if matchPatterns(c.includePatterns, dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilterPatterns parses the IncludePatterns and ExcludePatterns.
+func (c *Car) parseFilterPatterns() {
+	c.includePatterns = parsePatterns(".", []byte(strings.Join(c.IncludePatterns, "\n")))
+	c.excludePatterns = parsePatterns(".", []byte(strings.Join(c.ExcludePatterns, "\n")))
+}
@@ -0,0 +1,145 @@
+package carchivum
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		isDir    bool
+		expected bool
+	}{
+		{[]string{"*.log"}, "a.log", false, true},
+		{[]string{"*.log"}, "dir/sub/a.log", false, true},
+		{[]string{"*.log", "!keep.log"}, "dir/keep.log", false, false},
+		{[]string{"/a.log"}, "dir/a.log", false, false},
+		{[]string{"/a.log"}, "a.log", false, true},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "src/build", true, true},
+		{[]string{"doc/*.txt"}, "doc/a.txt", false, true},
+		{[]string{"doc/*.txt"}, "doc/sub/a.txt", false, false},
+		{[]string{"doc/**/*.txt"}, "doc/a.txt", false, true},
+		{[]string{"doc/**/*.txt"}, "doc/sub/deeper/a.txt", false, true},
+		{[]string{"**/node_modules/**"}, "node_modules/x/y.js", false, true},
+		{[]string{"**/node_modules/**"}, "a/b/node_modules/y.js", false, true},
+		{[]string{"**/node_modules/**"}, "a/node_modules_old/y.js", false, false},
+		{[]string{"# comment", "", "\\#hash"}, "#hash", false, true},
+		{[]string{"a/**"}, "a", true, false},
+		{[]string{"a/**"}, "a/b", true, true},
+	}
+	for i, test := range tests {
+		var ps []pattern
+		for _, s := range test.patterns {
+			ps = append(ps, parsePatterns(".", []byte(s))...)
+		}
+		matched := matchPatterns(ps, test.rel, test.isDir)
+		if matched != test.expected {
+			t.Errorf("%d: %v %s: expected %t, got %t", i, test.patterns, test.rel, test.expected, matched)
+		}
+	}
+}
+
+func TestFilterPatterns(t *testing.T) {
+	files := map[string]string{
+		"src/main.go":               "main",
+		"src/main.log":              "log",
+		"src/keep.log":              "keep",
+		"src/.gitignore":            "*.log\n!keep.log\ngen/\n",
+		"src/gen/out.go":            "generated",
+		"src/node_modules/x/y.js":   "js",
+		"src/lib/node_modules/z.js": "js",
+		"src/lib/lib.go":            "lib",
+		"src/lib/.carignore":        "/lib.go\n",
+		"src/doc/readme.txt":        "readme",
+	}
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		ignore   []string
+		expected []string
+	}{
+		{"all", nil, nil, nil, []string{
+			"src/.gitignore", "src/doc/readme.txt", "src/gen/out.go", "src/keep.log", "src/lib/.carignore",
+			"src/lib/lib.go", "src/lib/node_modules/z.js", "src/main.go", "src/main.log", "src/node_modules/x/y.js",
+		}},
+		{"ignore files", nil, []string{"**/node_modules/"}, DefaultIgnoreFiles, []string{
+			"src/.gitignore", "src/doc/readme.txt", "src/keep.log", "src/lib/.carignore", "src/main.go",
+		}},
+		{"include", []string{"*.go", "doc/"}, []string{"gen/"}, nil, []string{
+			"src/doc/readme.txt", "src/lib/lib.go", "src/main.go",
+		}},
+	}
+	mapFS := fstest.MapFS{}
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	for name, content := range files {
+		mapFS[name] = &fstest.MapFile{Data: []byte(content), Mode: 0644}
+		p := filepath.Join(tmpDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	for _, test := range tests {
+		// from an fs.FS and from OS paths
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			newZ := NewZip("")
+			newZ.IncludePatterns = test.include
+			newZ.ExcludePatterns = test.exclude
+			newZ.IgnoreFiles = test.ignore
+			if i == 0 {
+				_, err = newZ.CreateFSTo(&buf, mapFS, "src")
+			} else {
+				_, err = newZ.CreateTo(&buf, filepath.Join(tmpDir, "src"))
+			}
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+				continue
+			}
+			zipFS, err := NewZipFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+				continue
+			}
+			var names []string
+			fs.WalkDir(zipFS, ".", func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					names = append(names, p)
+				}
+				return err
+			})
+			sort.Strings(names)
+			if len(names) != len(test.expected) {
+				t.Errorf("%s %d: expected %v, got %v", test.name, i, test.expected, names)
+				continue
+			}
+			for j := range names {
+				if names[j] != test.expected[j] {
+					t.Errorf("%s %d: expected %v, got %v", test.name, i, test.expected, names)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	magicnum "github.com/mohae/magicnum/compress"
+)
+
+// IndexExt is the extension of a tarball's side-car index file.
+const IndexExt = ".idx"
+
+// DefaultIndexSpan is the default amount of uncompressed data between the
+// checkpoints of an Index.
+const DefaultIndexSpan = 1 << 20
+
+const (
+	indexMagic   = "CARINDEX"
+	indexVersion = 1
+)
+
+// the formats that can be indexed and their codes in an index file.
+var indexFormats = map[magicnum.Format]byte{
+	magicnum.Tar:   1,
+	magicnum.GZip:  2,
+	magicnum.BZip2: 3,
+	magicnum.LZ4:   4,
+}
+
+// Index is a random-access index of a tarball: the offset of each entry's
+// header in the uncompressed tar and a list of checkpoints from which the
+// tarball's decompression can be resumed. This allows a file to be read
+// without decompressing everything before it.
+//
+// For gzip, the checkpoints are the start of each gzip member and deflate
+// block boundaries along with the 32 KiB window that precedes them. For lz4,
+// they are the start of each frame and of blocks; dependent blocks also
+// have the 64 KiB window that precedes them. Bzip2 compressed tarballs are
+// indexed without checkpoints.
+type Index struct {
+	// Format is the tarball's compression format.
+	Format magicnum.Format
+	// Size is the size of the tarball; it is used to detect a stale index.
+	Size    int64
+	Entries []IndexEntry
+	// the checkpoints, in order of their offsets.
+	checkpoints []checkpoint
+}
+
+// IndexEntry is an indexed tar entry.
+type IndexEntry struct {
+	Name string
+	// Offset is the offset of the entry's header in the uncompressed tar.
+	Offset int64
+	// Size is the size of the entry's content.
+	Size int64
+}
+
+// checkpoint is a point from which a tarball's decompression can be resumed.
+type checkpoint struct {
+	// in is the offset of the checkpoint in the compressed tarball and bits
+	// is the number of bits of that byte that precede it.
+	in   int64
+	bits uint8
+	// out is the offset of the checkpoint in the uncompressed tar.
+	out int64
+	// member is true if the checkpoint is the start of a gzip member or an
+	// lz4 frame.
+	member bool
+	// flags is the FLG byte of the checkpoint's lz4 frame.
+	flags byte
+	// window is the uncompressed data that precedes the checkpoint, if it is
+	// needed to resume decompression.
+	window []byte
+}
+
+// BuildIndex returns an Index of the tarball read from r. Span is the
+// approximate amount of uncompressed data between checkpoints; if it is <=
+// 0, DefaultIndexSpan is used. Encrypted tarballs can't be indexed.
+func BuildIndex(r io.Reader, span int64) (*Index, error) {
+	if span <= 0 {
+		span = DefaultIndexSpan
+	}
+	br := bufio.NewReader(r)
+	b, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte(cryptMagic)) {
+		return nil, fmt.Errorf("encrypted tarballs can't be indexed")
+	}
+	format, err := magicnum.GetFormat(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := indexFormats[format]; !ok {
+		return nil, fmt.Errorf("%s can't be indexed: %w", format, ErrUnsupportedFormat)
+	}
+	var cnt countWriter
+	src := io.TeeReader(br, &cnt)
+	var tr io.Reader
+	var checkpoints func() []checkpoint
+	switch format {
+	case magicnum.Tar:
+		tr = src
+	case magicnum.GZip:
+		s := newGzipScanner(src, span)
+		tr, checkpoints = s, func() []checkpoint { return s.checkpoints }
+	case magicnum.LZ4:
+		s := newLZ4Scanner(src, span)
+		tr, checkpoints = s, func() []checkpoint { return s.checkpoints }
+	default:
+		rc, err := decompress(src, format)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		tr = rc
+	}
+	x := &Index{Format: format}
+	x.Entries, err = indexEntries(tr)
+	if err != nil {
+		return nil, err
+	}
+	// read anything that follows the tar so that the size is right.
+	_, err = io.Copy(io.Discard, tr)
+	if err != nil {
+		return nil, err
+	}
+	x.Size = int64(cnt)
+	if checkpoints != nil {
+		x.checkpoints = checkpoints()
+	}
+	return x, nil
+}
+
+// indexEntries returns the entries of the tar read from r.
+func indexEntries(r io.Reader) ([]IndexEntry, error) {
+	cr := &countReader{r: bufio.NewReader(r)}
+	tr := tar.NewReader(cr)
+	var entries []IndexEntry
+	for {
+		// once an entry's content has been read, the next header starts
+		// at the next block.
+		offset := (cr.n + blockSize - 1) / blockSize * blockSize
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		entries = append(entries, IndexEntry{Name: hdr.Name, Offset: offset, Size: hdr.Size})
+		_, err = io.Copy(io.Discard, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// blockSize is the size of a tar block.
+const blockSize = 512
+
+// Lookup returns the named entry. If there is more than one entry with the
+// name, the last one is returned.
+func (x *Index) Lookup(name string) (IndexEntry, bool) {
+	for i := len(x.Entries) - 1; i >= 0; i-- {
+		if x.Entries[i].Name == name {
+			return x.Entries[i], true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// Open returns the header and a reader of the content of the named entry
+// of the indexed tarball, of size bytes, read from r. Only the data from
+// the last checkpoint before the entry is decompressed.
+func (x *Index) Open(r io.ReaderAt, size int64, name string) (*tar.Header, io.Reader, error) {
+	if size != x.Size {
+		return nil, nil, fmt.Errorf("the index is stale: the tarball's size is %d, the indexed size is %d", size, x.Size)
+	}
+	e, ok := x.Lookup(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: not found in the index", name)
+	}
+	c := x.checkpoint(e.Offset)
+	src, err := x.resume(r, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = io.CopyN(io.Discard, src, e.Offset-c.out)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(src)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != e.Name {
+		return nil, nil, fmt.Errorf("%s: the index doesn't match the tarball", name)
+	}
+	return hdr, tr, nil
+}
+
+// checkpoint returns the last checkpoint at, or before, the offset in the
+// uncompressed tar. The zero checkpoint is the start of the tarball.
+func (x *Index) checkpoint(offset int64) checkpoint {
+	var c checkpoint
+	for _, v := range x.checkpoints {
+		if v.out > offset {
+			break
+		}
+		c = v
+	}
+	return c
+}
+
+// resume returns a reader of the uncompressed tar from the checkpoint c.
+func (x *Index) resume(r io.ReaderAt, c checkpoint) (io.Reader, error) {
+	if x.Format == magicnum.Tar {
+		return io.NewSectionReader(r, c.out, x.Size-c.out), nil
+	}
+	if c.in == 0 {
+		c.member = true
+	}
+	sr := io.NewSectionReader(r, c.in, x.Size-c.in)
+	switch {
+	case x.Format == magicnum.LZ4:
+		return resumeLZ4(sr, c), nil
+	case x.Format != magicnum.GZip || c.member:
+		return decompress(sr, x.Format)
+	}
+	s, err := newShiftReader(sr, uint(c.bits))
+	if err != nil {
+		return nil, err
+	}
+	// once the member's deflate stream ends, the tar continues in the
+	// next member, if there is one.
+	fr := flate.NewReaderDict(s, c.window)
+	for _, v := range x.checkpoints {
+		if v.member && v.in > c.in {
+			next := io.NewSectionReader(r, v.in, x.Size-v.in)
+			return io.MultiReader(fr, &lazyReader{open: func() (io.Reader, error) {
+				return gzip.NewReader(next)
+			}}), nil
+		}
+	}
+	return fr, nil
+}
+
+// lazyReader opens its reader when it is first read.
+type lazyReader struct {
+	open func() (io.Reader, error)
+	r    io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.r = r
+	}
+	return l.r.Read(p)
+}
+
+// WriteTo writes the index to w. The index file is the index magic, its
+// version, and the gzip'd index.
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	code, ok := indexFormats[x.Format]
+	if !ok {
+		return 0, fmt.Errorf("%s can't be indexed: %w", x.Format, ErrUnsupportedFormat)
+	}
+	var cnt countWriter
+	mw := io.MultiWriter(w, &cnt)
+	_, err := mw.Write(append([]byte(indexMagic), indexVersion))
+	if err != nil {
+		return int64(cnt), err
+	}
+	zw := gzip.NewWriter(mw)
+	bw := bufio.NewWriter(zw)
+	var b []byte
+	b = append(b, code)
+	b = binary.AppendUvarint(b, uint64(x.Size))
+	b = binary.AppendUvarint(b, uint64(len(x.Entries)))
+	bw.Write(b)
+	for _, e := range x.Entries {
+		b = binary.AppendUvarint(b[:0], uint64(len(e.Name)))
+		b = append(b, e.Name...)
+		b = binary.AppendUvarint(b, uint64(e.Offset))
+		b = binary.AppendUvarint(b, uint64(e.Size))
+		bw.Write(b)
+	}
+	b = binary.AppendUvarint(b[:0], uint64(len(x.checkpoints)))
+	bw.Write(b)
+	for _, c := range x.checkpoints {
+		var flags byte
+		if c.member {
+			flags = 1
+		}
+		b = append(b[:0], flags, c.bits, c.flags)
+		b = binary.AppendUvarint(b, uint64(c.in))
+		b = binary.AppendUvarint(b, uint64(c.out))
+		b = binary.AppendUvarint(b, uint64(len(c.window)))
+		b = append(b, c.window...)
+		bw.Write(b)
+	}
+	err = bw.Flush()
+	if err != nil {
+		return int64(cnt), err
+	}
+	err = zw.Close()
+	return int64(cnt), err
+}
+
+// ReadIndex reads an index written by Index.WriteTo from r.
+func ReadIndex(r io.Reader) (*Index, error) {
+	b := make([]byte, len(indexMagic)+1)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	if string(b[:len(indexMagic)]) != indexMagic {
+		return nil, fmt.Errorf("not a tarball index")
+	}
+	if b[len(indexMagic)] != indexVersion {
+		return nil, fmt.Errorf("unsupported tarball index version: %d", b[len(indexMagic)])
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(zr)
+	ir := &indexReader{r: br}
+	x := &Index{}
+	code := ir.byte()
+	for f, c := range indexFormats {
+		if c == code {
+			x.Format = f
+		}
+	}
+	x.Size = ir.int()
+	n := ir.int()
+	for i := int64(0); i < n && ir.err == nil; i++ {
+		var e IndexEntry
+		e.Name = string(ir.bytes(ir.int()))
+		e.Offset = ir.int()
+		e.Size = ir.int()
+		x.Entries = append(x.Entries, e)
+	}
+	n = ir.int()
+	for i := int64(0); i < n && ir.err == nil; i++ {
+		var c checkpoint
+		c.member = ir.byte() == 1
+		c.bits = ir.byte()
+		c.flags = ir.byte()
+		c.in = ir.int()
+		c.out = ir.int()
+		if w := ir.bytes(ir.int()); len(w) > 0 {
+			c.window = w
+		}
+		x.checkpoints = append(x.checkpoints, c)
+	}
+	if ir.err != nil {
+		if ir.err == io.EOF {
+			ir.err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("invalid tarball index: %s", ir.err)
+	}
+	if _, ok := indexFormats[x.Format]; !ok || code == 0 {
+		return nil, fmt.Errorf("invalid tarball index: unknown format %d", code)
+	}
+	return x, nil
+}
+
+// indexReader reads the fields of an index; once an error occurs, it
+// returns zero values.
+type indexReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (ir *indexReader) byte() byte {
+	if ir.err != nil {
+		return 0
+	}
+	var b byte
+	b, ir.err = ir.r.ReadByte()
+	return b
+}
+
+func (ir *indexReader) int() int64 {
+	if ir.err != nil {
+		return 0
+	}
+	var v uint64
+	v, ir.err = binary.ReadUvarint(ir.r)
+	if ir.err == nil && v > 1<<62 {
+		ir.err = fmt.Errorf("value out of range")
+	}
+	return int64(v)
+}
+
+func (ir *indexReader) bytes(n int64) []byte {
+	if ir.err != nil {
+		return nil
+	}
+	if n > lz4Window {
+		// names are limited by the tar format, windows by the formats.
+		ir.err = fmt.Errorf("field too large")
+		return nil
+	}
+	b := make([]byte, n)
+	_, ir.err = io.ReadFull(ir.r, b)
+	return b
+}
+
+// ReadIndexFile reads the named index file.
+func ReadIndexFile(name string) (*Index, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadIndex(f)
+}
+
+// WriteIndexFile writes the index to the named file.
+func (x *Index) WriteIndexFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = x.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tarIndexer indexes a gzip'd tarball as it is created. The gzip stream is
+// flushed at each checkpoint so that the checkpoint is byte aligned. For a
+// seekable tarball, the checkpoints are made by its seekWriter.
+type tarIndexer struct {
+	x    *Index
+	span int64
+	last int64
+	zw   *gzip.Writer
+	sw   *seekWriter
+	// in counts the compressed bytes and out the uncompressed ones.
+	in  *countWriter
+	out windowWriter
+}
+
+// entry indexes the entry whose header is about to be written to tw. If it
+// is at least span bytes from the last checkpoint, a checkpoint is made.
+func (ti *tarIndexer) entry(tw *tar.Writer, hdr *tar.Header) error {
+	// write the padding of the previous entry so that the offset is that
+	// of the header.
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	offset := ti.out.n
+	switch {
+	case ti.sw != nil:
+		offset = ti.sw.out
+		if ti.sw.span == 0 {
+			err = ti.sw.restart()
+			if err != nil {
+				return err
+			}
+		}
+	case ti.zw != nil && offset-ti.last >= ti.span:
+		err = ti.zw.Flush()
+		if err != nil {
+			return err
+		}
+		ti.x.checkpoints = append(ti.x.checkpoints, checkpoint{in: int64(*ti.in), out: offset, window: append([]byte(nil), ti.out.window()...)})
+		ti.last = offset
+	}
+	ti.x.Entries = append(ti.x.Entries, IndexEntry{Name: hdr.Name, Offset: offset, Size: hdr.Size})
+	return nil
+}
+
+// windowWriter counts the bytes written to it and keeps the last window of
+// them.
+type windowWriter struct {
+	n   int64
+	buf []byte
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > 2*deflateWindow {
+		w.buf = w.buf[:copy(w.buf, w.buf[len(w.buf)-deflateWindow:])]
+	}
+	return len(p), nil
+}
+
+func (w *windowWriter) window() []byte {
+	if len(w.buf) > deflateWindow {
+		return w.buf[len(w.buf)-deflateWindow:]
+	}
+	return w.buf
+}
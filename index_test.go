@@ -0,0 +1,279 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// indexTestFiles returns files with enough content, which compresses, that
+// an index of them has checkpoints.
+func indexTestFiles() []testFile {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"carchivum", "tar", "gzip", "index", "checkpoint", "window", "deflate", "block"}
+	var files []testFile
+	for i := 0; i < 24; i++ {
+		var b bytes.Buffer
+		for b.Len() < 20000+r.Intn(20000) {
+			fmt.Fprintf(&b, "%s %d ", words[r.Intn(len(words))], r.Intn(1000))
+		}
+		files = append(files, testFile{name: fmt.Sprintf("index/%02d.txt", i), content: b.Bytes()})
+	}
+	return files
+}
+
+// createIndexTestFiles writes the files to a temporary directory.
+func createIndexTestFiles(files []testFile) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		err = os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(f.name)), 0755)
+		if err != nil {
+			return tmpDir, err
+		}
+		err = ioutil.WriteFile(filepath.Join(tmpDir, f.name), f.content, 0644)
+		if err != nil {
+			return tmpDir, err
+		}
+	}
+	return tmpDir, nil
+}
+
+func writeTestTar(w io.Writer, files []testFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(f.content)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func checkIndex(t *testing.T, name string, x *Index, r io.ReaderAt, size int64, files []testFile) {
+	if len(x.Entries) != len(files) {
+		t.Errorf("%s: expected %d entries, got %d", name, len(files), len(x.Entries))
+	}
+	for _, f := range files {
+		_, tr, err := x.Open(r, size, f.name)
+		if err != nil {
+			t.Errorf("%s: %s: expected error to be nil, got %q", name, f.name, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Errorf("%s: %s: expected error to be nil, got %q", name, f.name, err)
+			continue
+		}
+		if !bytes.Equal(b, f.content) {
+			t.Errorf("%s: %s: content didn't match", name, f.name)
+		}
+	}
+}
+
+func TestTarIndex(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.CreateIndex = true
+	newT.IndexSpan = 64 * 1024
+	_, err = newT.Create(filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	x, err := ReadIndexFile(newT.Name + IndexExt)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if len(x.checkpoints) < 2 {
+		t.Errorf("Expected the index to have checkpoints, got %d", len(x.checkpoints))
+	}
+	tgz, err := ioutil.ReadFile(newT.Name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	checkIndex(t, "create", x, bytes.NewReader(tgz), int64(len(tgz)), files)
+	// an index built on demand from the same tarball
+	x, err = BuildIndex(bytes.NewReader(tgz), 64*1024)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if len(x.checkpoints) < 2 {
+		t.Errorf("Expected the index to have checkpoints, got %d", len(x.checkpoints))
+	}
+	var buf bytes.Buffer
+	_, err = x.WriteTo(&buf)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	x, err = ReadIndex(&buf)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	checkIndex(t, "build", x, bytes.NewReader(tgz), int64(len(tgz)), files)
+	// extract a member
+	newT.OutDir = filepath.Join(tmpDir, "out")
+	err = newT.ExtractMember(files[20].name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(newT.OutDir, files[20].name))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if !bytes.Equal(b, files[20].content) {
+		t.Errorf("%s: content didn't match", files[20].name)
+	}
+	_, err = os.Stat(filepath.Join(newT.OutDir, files[19].name))
+	if err == nil {
+		t.Errorf("Expected only %s to be extracted", files[20].name)
+	}
+}
+
+func TestGzipIndex(t *testing.T) {
+	files := indexTestFiles()
+	var tb bytes.Buffer
+	err := writeTestTar(&tb, files)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// the levels use stored, fixed, and dynamic blocks.
+	levels := []int{gzip.NoCompression, gzip.HuffmanOnly, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression}
+	for _, level := range levels {
+		var gz bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&gz, level)
+		zw.Write(tb.Bytes())
+		zw.Close()
+		x, err := BuildIndex(bytes.NewReader(gz.Bytes()), 32*1024)
+		if err != nil {
+			t.Errorf("level %d: expected error to be nil, got %q", level, err)
+			continue
+		}
+		checkIndex(t, fmt.Sprintf("level %d", level), x, bytes.NewReader(gz.Bytes()), int64(gz.Len()), files)
+	}
+	// a multi-member gzip, split in the middle of a file
+	var gz bytes.Buffer
+	for _, b := range [][]byte{tb.Bytes()[:300000], tb.Bytes()[300000:]} {
+		zw := gzip.NewWriter(&gz)
+		zw.Write(b)
+		zw.Close()
+	}
+	x, err := BuildIndex(bytes.NewReader(gz.Bytes()), 32*1024)
+	if err != nil {
+		t.Errorf("multi-member: expected error to be nil, got %q", err)
+		return
+	}
+	checkIndex(t, "multi-member", x, bytes.NewReader(gz.Bytes()), int64(gz.Len()), files)
+	// a corrupt gzip
+	b := append([]byte(nil), gz.Bytes()...)
+	b[len(b)/3] ^= 0xff
+	_, err = BuildIndex(bytes.NewReader(b), 32*1024)
+	if err == nil {
+		t.Error("Expected an error for a corrupt gzip, got none")
+	}
+}
+
+// lz4Frame returns data as an lz4 frame of independent blocks. Odd blocks are
+// stored uncompressed, even ones as compressed blocks of literals.
+func lz4Frame(data []byte, blockSize int) []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, lz4Magic)
+	b = append(b, 1<<6|lz4FlagIndependent, 4<<4, 0)
+	for i := 0; len(data) > 0; i++ {
+		n := blockSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if i%2 == 1 {
+			b = binary.LittleEndian.AppendUint32(b, uint32(n)|lz4Uncompressed)
+			b = append(b, data[:n]...)
+		} else {
+			var blk []byte
+			if n < 15 {
+				blk = append(blk, byte(n<<4))
+			} else {
+				blk = append(blk, 0xf0)
+				l := n - 15
+				for ; l >= 255; l -= 255 {
+					blk = append(blk, 255)
+				}
+				blk = append(blk, byte(l))
+			}
+			blk = append(blk, data[:n]...)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(blk)))
+			b = append(b, blk...)
+		}
+		data = data[n:]
+	}
+	return binary.LittleEndian.AppendUint32(b, 0)
+}
+
+func TestLZ4Index(t *testing.T) {
+	files := indexTestFiles()
+	var tb bytes.Buffer
+	err := writeTestTar(&tb, files)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// two frames, with a skippable frame between them.
+	frames := lz4Frame(tb.Bytes()[:200000], 64*1024)
+	frames = binary.LittleEndian.AppendUint32(frames, lz4SkippableMagic|3)
+	frames = binary.LittleEndian.AppendUint32(frames, 4)
+	frames = append(frames, "skip"...)
+	frames = append(frames, lz4Frame(tb.Bytes()[200000:], 64*1024)...)
+	x, err := BuildIndex(bytes.NewReader(frames), 64*1024)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if len(x.checkpoints) < 4 {
+		t.Errorf("Expected the index to have checkpoints, got %d", len(x.checkpoints))
+	}
+	checkIndex(t, "lz4", x, bytes.NewReader(frames), int64(len(frames)), files)
+}
+
+func TestLZ4Decode(t *testing.T) {
+	// "abc" followed by a match of 9 bytes at an offset of 3, then "d".
+	block := []byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, 'd'}
+	b, err := lz4Decode(nil, 0, block)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if string(b) != "abcabcabcabcd" {
+		t.Errorf("Expected %q, got %q", "abcabcabcabcd", b)
+	}
+	_, err = lz4Decode(nil, 0, []byte{0x35, 'a', 'b', 'c', 4, 0, 0x10, 'd'})
+	if err == nil {
+		t.Error("Expected an error for an invalid offset, got none")
+	}
+}
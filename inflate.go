@@ -0,0 +1,582 @@
+package carchivum
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// errCorruptDeflate is returned when a gzip stream's deflate data is invalid.
+var errCorruptDeflate = errors.New("gzip: invalid deflate data")
+
+// deflate's window size and the maximum number of bits in a Huffman code.
+const (
+	deflateWindow = 1 << 15
+	maxCodeBits   = 15
+	// codes up to fastBits long are decoded using a lookup table.
+	fastBits = 9
+)
+
+// the base values, and extra bits, of the length and distance codes.
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// the order of the code length code lengths of a dynamic block.
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffman is a canonical Huffman code.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol []uint16
+	// fast is indexed by the next fastBits bits of the stream; a non-zero
+	// entry is the symbol<<4 | the code's length.
+	fast [1 << fastBits]uint16
+}
+
+// newHuffman returns the Huffman code whose code lengths, by symbol, are
+// lengths.
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbol: make([]uint16, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return nil, errCorruptDeflate
+		}
+	}
+	var offs [maxCodeBits + 2]uint16
+	for l := 1; l <= maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	// the codes are assigned in order of length, then symbol; the stream
+	// has them bit reversed.
+	code, i := 0, 0
+	for l := 1; l <= fastBits; l++ {
+		for n := 0; n < int(h.count[l]); n++ {
+			rev := 0
+			for b := 0; b < l; b++ {
+				rev |= (code >> b & 1) << (l - 1 - b)
+			}
+			for j := rev; j < 1<<fastBits; j += 1 << l {
+				h.fast[j] = h.symbol[i]<<4 | uint16(l)
+			}
+			code++
+			i++
+		}
+		code <<= 1
+	}
+	return h, nil
+}
+
+var fixedLength, fixedDist *huffman
+
+func init() {
+	var l [288]uint8
+	for i := range l {
+		switch {
+		case i < 144:
+			l[i] = 8
+		case i < 256:
+			l[i] = 9
+		case i < 280:
+			l[i] = 7
+		default:
+			l[i] = 8
+		}
+	}
+	fixedLength, _ = newHuffman(l[:])
+	var d [30]uint8
+	for i := range d {
+		d[i] = 5
+	}
+	fixedDist, _ = newHuffman(d[:])
+}
+
+// gzipScanner decompresses a gzip stream, which may have multiple members,
+// and records checkpoints from which its decompression can be resumed: the
+// start of each member and, about every span bytes of output, the boundary
+// between two deflate blocks along with the window preceding it. It's used to
+// index gzip'd tarballs that weren't indexed when they were created;
+// decompressing from a checkpoint is done using compress/flate.
+type gzipScanner struct {
+	r     *bufio.Reader
+	in    int64 // bytes read from r
+	bits  uint64
+	nbits uint
+	// hist is the output; hist[:pos] has been read and out is the offset of
+	// hist[0] in the output.
+	hist []byte
+	pos  int
+	out  int64
+	// the state of the current member.
+	member     bool
+	memberOut  int64
+	crc        uint32
+	block      int // 0: between blocks, 1: stored, 2: Huffman
+	final      bool
+	stored     int
+	lit, dist  *huffman
+	span, last int64
+	// the recorded checkpoints
+	checkpoints []checkpoint
+	err         error
+}
+
+func newGzipScanner(r io.Reader, span int64) *gzipScanner {
+	return &gzipScanner{r: bufio.NewReader(r), span: span}
+}
+
+func (s *gzipScanner) Read(p []byte) (int, error) {
+	for s.pos == len(s.hist) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.step()
+	}
+	n := copy(p, s.hist[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+// offset returns the offset of the end of the output.
+func (s *gzipScanner) offset() int64 {
+	return s.out + int64(len(s.hist))
+}
+
+// step decompresses some more of the stream.
+func (s *gzipScanner) step() error {
+	// keep the window, and anything that hasn't been read.
+	if n := len(s.hist) - deflateWindow; s.pos == len(s.hist) && n >= deflateWindow {
+		copy(s.hist, s.hist[n:])
+		s.hist = s.hist[:deflateWindow]
+		s.pos = deflateWindow
+		s.out += int64(n)
+	}
+	mark := len(s.hist)
+	var err error
+	switch {
+	case !s.member:
+		return s.header()
+	case s.block == 0 && s.final:
+		return s.trailer()
+	case s.block == 0:
+		s.checkpoint()
+		err = s.blockHeader()
+	case s.block == 1:
+		err = s.copyStored()
+	default:
+		err = s.inflate()
+	}
+	s.crc = crc32.Update(s.crc, crc32.IEEETable, s.hist[mark:])
+	return err
+}
+
+// fill ensures that there are at least n bits in the bit buffer.
+func (s *gzipScanner) fill(n uint) error {
+	for s.nbits < n {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		s.in++
+		s.bits |= uint64(b) << s.nbits
+		s.nbits += 8
+	}
+	return nil
+}
+
+func (s *gzipScanner) getBits(n uint) (uint32, error) {
+	err := s.fill(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	v := uint32(s.bits & (1<<n - 1))
+	s.bits >>= n
+	s.nbits -= n
+	return v, nil
+}
+
+// header reads a member's header. The stream ends if there isn't another
+// member.
+func (s *gzipScanner) header() error {
+	// the bit buffer is byte aligned between members.
+	if s.nbits == 0 {
+		_, err := s.r.Peek(1)
+		if err == io.EOF && len(s.checkpoints) > 0 {
+			return io.EOF
+		}
+	}
+	start := s.in - int64(s.nbits/8)
+	var b [10]byte
+	for i := range b {
+		v, err := s.getBits(8)
+		if err != nil {
+			return err
+		}
+		b[i] = byte(v)
+	}
+	if b[0] != 0x1f || b[1] != 0x8b || b[2] != 8 {
+		return fmt.Errorf("gzip: invalid header")
+	}
+	flg := b[3]
+	if flg&0x04 != 0 { // FEXTRA
+		n, err := s.getBits(16)
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			_, err = s.getBits(8)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flg&f == 0 {
+			continue
+		}
+		for {
+			v, err := s.getBits(8)
+			if err != nil {
+				return err
+			}
+			if v == 0 {
+				break
+			}
+		}
+	}
+	if flg&0x02 != 0 { // FHCRC
+		_, err := s.getBits(16)
+		if err != nil {
+			return err
+		}
+	}
+	s.member, s.final, s.block = true, false, 0
+	s.memberOut = s.offset()
+	s.crc = 0
+	s.checkpoints = append(s.checkpoints, checkpoint{in: start, out: s.memberOut, member: true})
+	s.last = s.memberOut
+	return nil
+}
+
+// trailer reads and checks a member's trailer.
+func (s *gzipScanner) trailer() error {
+	s.bits >>= s.nbits % 8
+	s.nbits -= s.nbits % 8
+	crc, err := s.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := s.getBits(32)
+	if err != nil {
+		return err
+	}
+	if crc != s.crc || size != uint32(s.offset()-s.memberOut) {
+		return fmt.Errorf("gzip: invalid checksum")
+	}
+	s.member = false
+	return nil
+}
+
+// checkpoint records the block boundary the stream is at if it is at least
+// span bytes of output from the last checkpoint.
+func (s *gzipScanner) checkpoint() {
+	out := s.offset()
+	if out-s.last < s.span {
+		return
+	}
+	pos := s.in*8 - int64(s.nbits)
+	// a stored block is byte aligned relative to the start of the stream,
+	// so decompression can't be resumed from a stored block that isn't.
+	if pos%8 != 0 && s.fill(3) == nil && s.bits>>1&3 == 0 {
+		return
+	}
+	w := s.hist
+	if len(w) > deflateWindow {
+		w = w[len(w)-deflateWindow:]
+	}
+	s.checkpoints = append(s.checkpoints, checkpoint{in: pos / 8, bits: uint8(pos % 8), out: out, window: append([]byte(nil), w...)})
+	s.last = out
+}
+
+// blockHeader reads the header of the next block.
+func (s *gzipScanner) blockHeader() error {
+	v, err := s.getBits(3)
+	if err != nil {
+		return err
+	}
+	s.final = v&1 == 1
+	switch v >> 1 {
+	case 0:
+		s.bits >>= s.nbits % 8
+		s.nbits -= s.nbits % 8
+		v, err = s.getBits(32)
+		if err != nil {
+			return err
+		}
+		if uint16(v) != ^uint16(v>>16) {
+			return errCorruptDeflate
+		}
+		s.stored = int(uint16(v))
+		s.block = 1
+	case 1:
+		s.lit, s.dist = fixedLength, fixedDist
+		s.block = 2
+	case 2:
+		err = s.dynamic()
+		if err != nil {
+			return err
+		}
+		s.block = 2
+	default:
+		return errCorruptDeflate
+	}
+	return nil
+}
+
+// dynamic reads the code lengths of a dynamic block.
+func (s *gzipScanner) dynamic() error {
+	v, err := s.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlen, ndist, ncode := int(v&0x1f)+257, int(v>>5&0x1f)+1, int(v>>10)+4
+	if nlen > 286 || ndist > 30 {
+		return errCorruptDeflate
+	}
+	var lengths [286 + 30]uint8
+	for i := 0; i < ncode; i++ {
+		v, err = s.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[i]] = uint8(v)
+	}
+	lencode, err := newHuffman(lengths[:19])
+	if err != nil {
+		return err
+	}
+	for i := range lengths[:19] {
+		lengths[i] = 0
+	}
+	for i := 0; i < nlen+ndist; {
+		sym, err := s.decode(lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			l = lengths[i-1]
+			rep, err = s.getBits(2)
+			rep += 3
+		case 17:
+			rep, err = s.getBits(3)
+			rep += 3
+		default:
+			rep, err = s.getBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > nlen+ndist {
+			return errCorruptDeflate
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorruptDeflate
+	}
+	s.lit, err = newHuffman(lengths[:nlen])
+	if err != nil {
+		return err
+	}
+	s.dist, err = newHuffman(lengths[nlen : nlen+ndist])
+	return err
+}
+
+// decode reads the next symbol using h.
+func (s *gzipScanner) decode(h *huffman) (int, error) {
+	if s.fill(fastBits) == nil {
+		e := h.fast[s.bits&(1<<fastBits-1)]
+		if e != 0 {
+			s.bits >>= e & 15
+			s.nbits -= uint(e & 15)
+			return int(e >> 4), nil
+		}
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := s.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+// copyStored copies up to a window of a stored block.
+func (s *gzipScanner) copyStored() error {
+	n := s.stored
+	if n > deflateWindow {
+		n = deflateWindow
+	}
+	for ; n > 0 && s.nbits >= 8; n-- {
+		s.hist = append(s.hist, byte(s.bits))
+		s.bits >>= 8
+		s.nbits -= 8
+		s.stored--
+	}
+	i := len(s.hist)
+	s.hist = append(s.hist, make([]byte, n)...)
+	_, err := io.ReadFull(s.r, s.hist[i:])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	s.in += int64(n)
+	s.stored -= n
+	if s.stored == 0 {
+		s.block = 0
+	}
+	return nil
+}
+
+// inflate decompresses up to about a window of a Huffman block.
+func (s *gzipScanner) inflate() error {
+	for end := len(s.hist) + deflateWindow; len(s.hist) < end; {
+		sym, err := s.decode(s.lit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			s.hist = append(s.hist, byte(sym))
+			continue
+		case sym == 256:
+			s.block = 0
+			return nil
+		case sym > 285:
+			return errCorruptDeflate
+		}
+		sym -= 257
+		v, err := s.getBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(v)
+		sym, err = s.decode(s.dist)
+		if err != nil {
+			return err
+		}
+		if sym > 29 {
+			return errCorruptDeflate
+		}
+		v, err = s.getBits(uint(distExtra[sym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[sym]) + int(v)
+		if int64(dist) > s.offset()-s.memberOut || dist > len(s.hist) {
+			return errCorruptDeflate
+		}
+		for i := 0; i < length; i++ {
+			s.hist = append(s.hist, s.hist[len(s.hist)-dist])
+		}
+	}
+	return nil
+}
+
+// shiftReader reads r starting at its bit'th bit, so that a deflate stream
+// can be resumed from a block boundary that isn't byte aligned.
+type shiftReader struct {
+	r   *bufio.Reader
+	bit uint
+	cur byte
+	err error
+}
+
+// newShiftReader returns a reader of r from its bit'th bit.
+func newShiftReader(r io.Reader, bit uint) (*shiftReader, error) {
+	s := &shiftReader{r: bufio.NewReader(r), bit: bit}
+	if bit == 0 {
+		return s, nil
+	}
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	s.cur = b
+	return s, nil
+}
+
+func (s *shiftReader) ReadByte() (byte, error) {
+	if s.bit == 0 {
+		return s.r.ReadByte()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	next, err := s.r.ReadByte()
+	if err != nil {
+		// the bits of the last byte are returned, padded with 0s.
+		s.err = err
+		return s.cur >> s.bit, nil
+	}
+	b := s.cur>>s.bit | next<<(8-s.bit)
+	s.cur = next
+	return b, nil
+}
+
+func (s *shiftReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := s.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
@@ -0,0 +1,25 @@
+package carchivum
+
+// Logger logs messages with alternating key-value pairs of attributes; a
+// *slog.Logger is a Logger. It must be safe for concurrent use. Nothing is
+// logged unless a Car has a Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// debug logs a debug message, if there is a Logger.
+func (c *Car) debug(msg string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Debug(msg, args...)
+	}
+}
+
+// logError logs an error message, if there is a Logger.
+func (c *Car) logError(msg string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Error(msg, args...)
+	}
+}
@@ -0,0 +1,56 @@
+package carchivum
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	var buf bytes.Buffer
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	newT.ExcludePatterns = []string{"00.txt"}
+	_, err = newT.Create(filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	log := buf.String()
+	if !strings.Contains(log, "msg=skipped") || !strings.Contains(log, "reason=ignored") {
+		t.Errorf("Expected 00.txt to be logged as skipped, got %q", log)
+	}
+	if strings.Count(log, "msg=added") != len(files)-1 {
+		t.Errorf("Expected %d files to be logged as added, got %q", len(files)-1, log)
+	}
+	buf.Reset()
+	newT.OutDir = filepath.Join(tmpDir, "out")
+	err = newT.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if strings.Count(buf.String(), "msg=extracted") != len(files)-1 {
+		t.Errorf("Expected %d files to be logged as extracted, got %q", len(files)-1, buf.String())
+	}
+	// nothing is logged without a Logger
+	buf.Reset()
+	newT.Logger = nil
+	err = newT.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %q", buf.String())
+	}
+}
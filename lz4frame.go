@@ -0,0 +1,285 @@
+package carchivum
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// lz4 frame constants.
+const (
+	lz4Magic               = 0x184d2204
+	lz4SkippableMagic      = 0x184d2a50 // the low 4 bits can be anything
+	lz4FlagIndependent     = 1 << 5
+	lz4FlagBlockChecksum   = 1 << 4
+	lz4FlagContentSize     = 1 << 3
+	lz4FlagContentChecksum = 1 << 2
+	lz4FlagDictID          = 1
+	lz4Uncompressed        = 1 << 31
+	// the window of dependent blocks
+	lz4Window = 64 * 1024
+	// the largest block size
+	lz4MaxBlock = 4 * 1024 * 1024
+)
+
+var errCorruptLZ4 = errors.New("lz4: invalid block")
+
+// lz4Scanner decompresses lz4 frames. It is used to index, and to resume the
+// decompression of, lz4 compressed tarballs: it records checkpoints at the
+// start of each frame and, about every span bytes of output, at the start of
+// a block. Unlike lz4.Reader, it can start decompressing at any block of a
+// frame. Block and content checksums are not checked.
+type lz4Scanner struct {
+	r  *bufio.Reader
+	in int64 // bytes read from r
+	// flags is the FLG byte of the current frame; the scanner is between
+	// frames if inFrame is false.
+	flags   byte
+	inFrame bool
+	// hist is the output; hist[:pos] has been read and out is the offset of
+	// hist[0] in the output.
+	hist  []byte
+	pos   int
+	out   int64
+	block []byte
+	// checkpoints are only recorded if span > 0.
+	span, last  int64
+	checkpoints []checkpoint
+	err         error
+}
+
+func newLZ4Scanner(r io.Reader, span int64) *lz4Scanner {
+	return &lz4Scanner{r: bufio.NewReader(r), span: span}
+}
+
+// resumeLZ4 returns a scanner of an lz4 stream, read from r, whose first
+// block is at the checkpoint c.
+func resumeLZ4(r io.Reader, c checkpoint) *lz4Scanner {
+	s := newLZ4Scanner(r, 0)
+	s.in = c.in
+	s.out = c.out - int64(len(c.window))
+	s.hist = append(s.hist, c.window...)
+	s.pos = len(s.hist)
+	if !c.member {
+		s.flags = c.flags
+		s.inFrame = true
+	}
+	return s
+}
+
+func (s *lz4Scanner) Read(p []byte) (int, error) {
+	for s.pos == len(s.hist) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.step()
+	}
+	n := copy(p, s.hist[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+func (s *lz4Scanner) readFull(b []byte) error {
+	n, err := io.ReadFull(s.r, b)
+	s.in += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// step reads the next frame header or block.
+func (s *lz4Scanner) step() error {
+	// keep the window, and anything that hasn't been read.
+	if n := len(s.hist) - lz4Window; s.pos == len(s.hist) && n >= lz4Window {
+		copy(s.hist, s.hist[n:])
+		s.hist = s.hist[:lz4Window]
+		s.pos = lz4Window
+		s.out += int64(n)
+	}
+	if !s.inFrame {
+		return s.header()
+	}
+	start := s.in
+	var b [4]byte
+	err := s.readFull(b[:])
+	if err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(b[:])
+	if size == 0 {
+		// the end mark
+		s.inFrame = false
+		if s.flags&lz4FlagContentChecksum != 0 {
+			return s.readFull(b[:])
+		}
+		return nil
+	}
+	out := s.out + int64(len(s.hist))
+	if s.span > 0 && out-s.last >= s.span {
+		c := checkpoint{in: start, out: out, flags: s.flags}
+		if s.flags&lz4FlagIndependent == 0 {
+			w := s.hist
+			if len(w) > lz4Window {
+				w = w[len(w)-lz4Window:]
+			}
+			c.window = append([]byte(nil), w...)
+		}
+		s.checkpoints = append(s.checkpoints, c)
+		s.last = out
+	}
+	n := int(size &^ lz4Uncompressed)
+	if n > lz4MaxBlock {
+		return errCorruptLZ4
+	}
+	if cap(s.block) < n {
+		s.block = make([]byte, n)
+	}
+	s.block = s.block[:n]
+	err = s.readFull(s.block)
+	if err != nil {
+		return err
+	}
+	if s.flags&lz4FlagBlockChecksum != 0 {
+		err = s.readFull(b[:])
+		if err != nil {
+			return err
+		}
+	}
+	if size&lz4Uncompressed != 0 {
+		s.hist = append(s.hist, s.block...)
+		return nil
+	}
+	// independent blocks can only refer to their own content.
+	base := len(s.hist)
+	if s.flags&lz4FlagIndependent == 0 {
+		base = 0
+	}
+	s.hist, err = lz4Decode(s.hist, base, s.block)
+	return err
+}
+
+// header reads a frame's header, skipping any skippable frames. The stream
+// ends if there isn't another frame.
+func (s *lz4Scanner) header() error {
+	for {
+		start := s.in
+		var b [4]byte
+		n, err := io.ReadFull(s.r, b[:])
+		s.in += int64(n)
+		if err != nil {
+			if err == io.EOF && start > 0 {
+				return io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(b[:])
+		if magic&^0xf == lz4SkippableMagic {
+			err = s.readFull(b[:])
+			if err != nil {
+				return err
+			}
+			m, err := s.r.Discard(int(binary.LittleEndian.Uint32(b[:])))
+			s.in += int64(m)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if magic != lz4Magic {
+			return fmt.Errorf("lz4: invalid frame")
+		}
+		err = s.readFull(b[:2])
+		if err != nil {
+			return err
+		}
+		s.flags = b[0]
+		if s.flags>>6 != 1 {
+			return fmt.Errorf("lz4: unsupported frame version")
+		}
+		// skip the block descriptor, optional content size and dictionary
+		// id, and the header checksum.
+		skip := 1
+		if s.flags&lz4FlagContentSize != 0 {
+			skip += 8
+		}
+		if s.flags&lz4FlagDictID != 0 {
+			skip += 4
+		}
+		m, err := s.r.Discard(skip)
+		s.in += int64(m)
+		if err != nil {
+			return err
+		}
+		s.inFrame = true
+		out := s.out + int64(len(s.hist))
+		if s.span > 0 {
+			s.checkpoints = append(s.checkpoints, checkpoint{in: start, out: out, member: true})
+			s.last = out
+		}
+		return nil
+	}
+}
+
+// lz4Decode appends the decompressed lz4 block, src, to dst. Matches can
+// refer to dst from base onwards.
+func lz4Decode(dst []byte, base int, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		lit := int(token >> 4)
+		if lit == 15 {
+			for {
+				if i >= len(src) {
+					return dst, errCorruptLZ4
+				}
+				b := src[i]
+				i++
+				lit += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		if lit > len(src)-i {
+			return dst, errCorruptLZ4
+		}
+		dst = append(dst, src[i:i+lit]...)
+		i += lit
+		// the last sequence only has literals
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return dst, errCorruptLZ4
+		}
+		off := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if off == 0 || off > len(dst)-base {
+			return dst, errCorruptLZ4
+		}
+		ml := int(token&15) + 4
+		if token&15 == 15 {
+			for {
+				if i >= len(src) {
+					return dst, errCorruptLZ4
+				}
+				b := src[i]
+				i++
+				ml += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		for ; ml > 0; ml-- {
+			dst = append(dst, dst[len(dst)-off])
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,155 @@
+package carchivum
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Overwrite is how files that already exist are handled when an archive is
+// extracted.
+type Overwrite int
+
+const (
+	// OverwriteExisting replaces existing files.
+	OverwriteExisting Overwrite = iota
+	// SkipExisting keeps existing files.
+	SkipExisting
+	// KeepNewer keeps existing files that aren't older than the archived
+	// file.
+	KeepNewer
+	// FailExisting returns an error, which wraps os.ErrExist, if a file
+	// exists.
+	FailExisting
+	// BackupExisting renames existing files by appending a numbered
+	// suffix, e.g. file.~1~, before they are replaced.
+	BackupExisting
+)
+
+// keepExisting returns whether the existing file, if any, at fname is kept
+// instead of being replaced by an extracted file modified at modTime.
+func (c *Car) keepExisting(fname string, modTime time.Time) (bool, error) {
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	switch c.Overwrite {
+	case SkipExisting:
+		c.skip(SkippedExisting, fname)
+		return true, nil
+	case KeepNewer:
+		keep := !modTime.After(fi.ModTime())
+		if keep {
+			c.skip(SkippedExisting, fname)
+		}
+		return keep, nil
+	case FailExisting:
+		return false, fmt.Errorf("%s: %w", fname, os.ErrExist)
+	}
+	return false, nil
+}
+
+// replace moves the existing file, if any, at fname out of the way: it is
+// backed up if the Overwrite policy is BackupExisting, otherwise it is
+// removed if it isn't a regular file, which a rename can't replace.
+func (c *Car) replace(fname string) error {
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if c.Overwrite == BackupExisting {
+		for i := 1; ; i++ {
+			backup := fname + ".~" + strconv.Itoa(i) + "~"
+			_, err = os.Lstat(backup)
+			if os.IsNotExist(err) {
+				err = os.Rename(fname, backup)
+				if err == nil {
+					c.backedUp(fname, backup)
+				}
+				return err
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !fi.Mode().IsRegular() {
+		return os.Remove(fname)
+	}
+	return nil
+}
+
+// extractFile is a file being extracted. It is written to a temporary file,
+// in the same directory, that is renamed to the file's name once it has been
+// written, so that an interrupted extraction never leaves a partially
+// written file in its place.
+type extractFile struct {
+	*os.File
+	c       *Car
+	name    string
+	modTime time.Time
+}
+
+// createFile returns the extractFile for fname, a file modified at modTime,
+// or nil if the existing file is kept. Its parent directories are created.
+func (c *Car) createFile(fname string, modTime time.Time) (*extractFile, error) {
+	err := c.mkdirAll(filepath.Dir(fname), 0744)
+	if err != nil {
+		return nil, err
+	}
+	keep, err := c.keepExisting(fname, modTime)
+	if err != nil || keep {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fname), "."+filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &extractFile{File: tmp, c: c, name: fname, modTime: modTime}, nil
+}
+
+// commit sets the file's permissions and modification time and moves it
+// into place; KeepNewer compares the entries against the modification time.
+func (f *extractFile) commit(perm os.FileMode) error {
+	err := f.File.Chmod(perm)
+	if err != nil {
+		f.abort()
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		f.abort()
+		return err
+	}
+	if !f.modTime.IsZero() {
+		err = os.Chtimes(f.File.Name(), f.modTime, f.modTime)
+		if err != nil {
+			os.Remove(f.File.Name())
+			return err
+		}
+	}
+	err = f.c.replace(f.name)
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	f.c.extractedFile(f.name)
+	return nil
+}
+
+// abort removes the temporary file.
+func (f *extractFile) abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
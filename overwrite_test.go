@@ -0,0 +1,193 @@
+package carchivum
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverwrite(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var tgz, zipped bytes.Buffer
+	_, err = NewTar("").CreateTo(&tgz, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	_, err = NewZip("").CreateTo(&zipped, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	archived := "some content\n"
+	existing := []byte("existing content\n")
+	tests := []struct {
+		name     string
+		policy   Overwrite
+		modTime  time.Time
+		expected string
+		backup   bool
+		err      error
+	}{
+		{"overwrite", OverwriteExisting, time.Now(), archived, false, nil},
+		{"skip", SkipExisting, time.Now().Add(-time.Hour), string(existing), false, nil},
+		{"keep newer: newer", KeepNewer, time.Now().Add(time.Hour), string(existing), false, nil},
+		{"keep newer: older", KeepNewer, time.Unix(0, 0), archived, false, nil},
+		{"fail", FailExisting, time.Now(), string(existing), false, os.ErrExist},
+		{"backup", BackupExisting, time.Now(), archived, true, nil},
+	}
+	for _, test := range tests {
+		// tar, zip, and streamed zip
+		for i := 0; i < 3; i++ {
+			dst := filepath.Join(tmpDir, "out")
+			fname := filepath.Join(dst, "test/test1.txt")
+			err = os.MkdirAll(filepath.Dir(fname), 0755)
+			if err != nil {
+				t.Errorf("Expected error to be nil, got %q", err)
+				return
+			}
+			err = ioutil.WriteFile(fname, existing, 0644)
+			if err != nil {
+				t.Errorf("Expected error to be nil, got %q", err)
+				return
+			}
+			err = os.Chtimes(fname, test.modTime, test.modTime)
+			if err != nil {
+				t.Errorf("Expected error to be nil, got %q", err)
+				return
+			}
+			switch i {
+			case 0:
+				newT := NewTar("")
+				newT.OutDir = dst
+				newT.Overwrite = test.policy
+				err = newT.ExtractArchive(bytes.NewReader(tgz.Bytes()))
+			case 1:
+				newZ := NewZip("")
+				newZ.OutDir = dst
+				newZ.Overwrite = test.policy
+				err = newZ.ExtractReaderAt(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+			case 2:
+				newZ := NewZip("")
+				newZ.OutDir = dst
+				newZ.Overwrite = test.policy
+				err = newZ.ExtractReader(bytes.NewReader(zipped.Bytes()))
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("%s %d: expected %v, got %v", test.name, i, test.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("%s %d: expected error to be nil, got %q", test.name, i, err)
+			}
+			b, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Errorf("%s %d: expected error to be nil, got %q", test.name, i, err)
+			} else if string(b) != test.expected {
+				t.Errorf("%s %d: expected %q, got %q", test.name, i, test.expected, b)
+			}
+			b, err = ioutil.ReadFile(fname + ".~1~")
+			if test.backup && (err != nil || !bytes.Equal(b, existing)) {
+				t.Errorf("%s %d: expected a backup of the existing file, got %q %v", test.name, i, b, err)
+			}
+			if !test.backup && err == nil {
+				t.Errorf("%s %d: expected there to not be a backup", test.name, i)
+			}
+			// the other files are extracted and there aren't any temporary
+			// files.
+			if test.err == nil {
+				b, err = ioutil.ReadFile(filepath.Join(dst, "test/test2.txt"))
+				if err != nil || string(b) != "some more content\n" {
+					t.Errorf("%s %d: expected test2.txt to be extracted, got %q %v", test.name, i, b, err)
+				}
+			}
+			files, _ := filepath.Glob(filepath.Join(dst, "test", ".*tmp*"))
+			if len(files) > 0 {
+				t.Errorf("%s %d: expected the temporary files to be removed, got %v", test.name, i, files)
+			}
+			os.RemoveAll(dst)
+		}
+	}
+}
+
+func TestKeepNewerReextract(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	src := filepath.Join(tmpDir, "src", "file.txt")
+	err = os.MkdirAll(filepath.Dir(src), 0755)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// an older and a newer version of the file, in a tarball and a zip.
+	older := time.Now().Add(-2 * time.Hour).Truncate(2 * time.Second)
+	newer := older.Add(time.Hour)
+	var tgz, zipped [2][]byte
+	for i, modTime := range []time.Time{older, newer} {
+		var tb, zb bytes.Buffer
+		err = ioutil.WriteFile(src, []byte(modTime.String()), 0644)
+		if err == nil {
+			err = os.Chtimes(src, modTime, modTime)
+		}
+		if err == nil {
+			_, err = NewTar("").CreateTo(&tb, filepath.Dir(src))
+		}
+		if err == nil {
+			_, err = NewZip("").CreateTo(&zb, filepath.Dir(src))
+		}
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		tgz[i], zipped[i] = tb.Bytes(), zb.Bytes()
+	}
+	fname := filepath.Join(tmpDir, "out", "src", "file.txt")
+	for i, archives := range [][2][]byte{tgz, zipped} {
+		extract := func(b []byte) error {
+			if i == 0 {
+				newT := NewTar("")
+				newT.OutDir = filepath.Join(tmpDir, "out")
+				newT.Overwrite = KeepNewer
+				return newT.ExtractArchive(bytes.NewReader(b))
+			}
+			newZ := NewZip("")
+			newZ.OutDir = filepath.Join(tmpDir, "out")
+			newZ.Overwrite = KeepNewer
+			return newZ.ExtractReaderAt(bytes.NewReader(b), int64(len(b)))
+		}
+		// the older file is extracted with its modification time, so the
+		// newer one replaces it, and re-extracting the older one doesn't.
+		for _, test := range []struct {
+			archive  []byte
+			expected time.Time
+		}{{archives[0], older}, {archives[1], newer}, {archives[0], newer}} {
+			err = extract(test.archive)
+			if err != nil {
+				t.Errorf("%d: expected error to be nil, got %q", i, err)
+				continue
+			}
+			b, err := ioutil.ReadFile(fname)
+			if err != nil || string(b) != test.expected.String() {
+				t.Errorf("%d: expected %q, got %q, %v", i, test.expected.String(), b, err)
+			}
+			fi, err := os.Stat(fname)
+			if err != nil || !fi.ModTime().Equal(test.expected) {
+				t.Errorf("%d: expected the modification time to be %s, got %v", i, test.expected, err)
+			}
+		}
+		os.RemoveAll(filepath.Join(tmpDir, "out"))
+	}
+}
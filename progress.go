@@ -0,0 +1,167 @@
+package carchivum
+
+import (
+	"io"
+	"time"
+)
+
+// EventType is the type of a progress Event.
+type EventType int
+
+const (
+	// EntryStarted is sent before a file is archived, or extracted.
+	EntryStarted EventType = iota
+	// EntryFinished is sent after a file has been archived, or extracted;
+	// Err is the error, if any.
+	EntryFinished
+	// BytesRead is sent as a file's content is read, N bytes at a time.
+	BytesRead
+	// BytesWritten is sent as the archive is written, N bytes at a time;
+	// it is only sent when an archive is created.
+	BytesWritten
+)
+
+// Event is the progress of an operation, see Observer. Directories aren't
+// counted.
+type Event struct {
+	Type EventType
+	// Name and Size are the entry's name and size.
+	Name string
+	Size int64
+	// N is the number of bytes read or written.
+	N   int64
+	Err error
+	// Files is the number of entries that have finished, Bytes is the
+	// number of bytes of content that have been read, and CompressedBytes
+	// is the number of bytes of the archive that have been written.
+	Files           int
+	Bytes           int64
+	CompressedBytes int64
+	// TotalFiles and TotalBytes are the number of files, and their size,
+	// that are being archived, if the sources were scanned, see PreScan;
+	// otherwise they are 0.
+	TotalFiles int
+	TotalBytes int64
+}
+
+// Observer is notified of the progress of creating, or extracting, an
+// archive. Observe isn't called concurrently.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is a func that is an Observer.
+type ObserverFunc func(Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// progress is the state of the progress of an operation.
+type progress struct {
+	files, totalFiles             int
+	bytes, compressed, totalBytes int64
+	scanning                      bool
+}
+
+// notify sends the event, with the progress so far, to the Observer.
+func (c *Car) notify(e Event) {
+	if c.Observer == nil {
+		return
+	}
+	e.Files = c.progress.files
+	e.Bytes = c.progress.bytes
+	e.CompressedBytes = c.progress.compressed
+	e.TotalFiles = c.progress.totalFiles
+	e.TotalBytes = c.progress.totalBytes
+	c.Observer.Observe(e)
+}
+
+// startProgress resets the progress, and the stats; if PreScan is set, the
+// sources are walked to get the totals.
+func (c *Car) startProgress(src []string) error {
+	c.begin(opCreate)
+	if !c.PreScan {
+		return nil
+	}
+	c.progress.scanning = true
+	defer func() { c.progress.scanning = false }()
+	return c.addSources(src)
+}
+
+// scanned counts a file that was found by the PreScan.
+func (c *Car) scanned(size int64, isDir bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isDir {
+		c.progress.totalFiles++
+		c.progress.totalBytes += size
+	}
+}
+
+// entryStarted notifies the Observer that the entry is started.
+func (c *Car) entryStarted(name string, size int64) {
+	c.notify(Event{Type: EntryStarted, Name: name, Size: size})
+}
+
+// entryFinished notifies the Observer that the entry is finished, and logs
+// it.
+func (c *Car) entryFinished(name string, size int64, err error) {
+	msg, fail := "added", "failed to add"
+	if c.stats.Operation == opExtract {
+		msg, fail = "extracted", "failed to extract"
+	}
+	if err != nil {
+		c.logError(fail, "name", name, "err", err)
+	} else {
+		c.debug(msg, "name", name, "size", size)
+	}
+	c.progress.files++
+	c.notify(Event{Type: EntryFinished, Name: name, Size: size, Err: err})
+}
+
+// progressReader returns a reader of r that counts, and times, the bytes
+// read and notifies the Observer, if there is one, of them.
+func (c *Car) progressReader(r io.Reader) io.Reader {
+	return &progressReader{c, r}
+}
+
+type progressReader struct {
+	c *Car
+	r io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	t := time.Now()
+	n, err := r.r.Read(p)
+	r.c.stats.Read += time.Since(t)
+	if n > 0 {
+		r.c.progress.bytes += int64(n)
+		r.c.notify(Event{Type: BytesRead, N: int64(n)})
+	}
+	return n, err
+}
+
+// progressWriter returns a writer of w that counts, and times, the
+// compressed bytes and notifies the Observer, if there is one, of them.
+func (c *Car) progressWriter(w io.Writer) io.Writer {
+	return &progressWriter{c, w}
+}
+
+type progressWriter struct {
+	c *Car
+	w io.Writer
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	t := time.Now()
+	n, err := w.w.Write(p)
+	w.c.stats.Write += time.Since(t)
+	if n > 0 {
+		w.c.compressedBytes += int64(n)
+		w.c.progress.compressed += int64(n)
+		w.c.notify(Event{Type: BytesWritten, N: int64(n)})
+	}
+	return n, err
+}
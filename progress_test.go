@@ -0,0 +1,97 @@
+package carchivum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// progressCounter counts the events it observes.
+type progressCounter struct {
+	started, finished int
+	read, written     int64
+	last              Event
+}
+
+func (p *progressCounter) Observe(e Event) {
+	switch e.Type {
+	case EntryStarted:
+		p.started++
+	case EntryFinished:
+		p.finished++
+	case BytesRead:
+		p.read += e.N
+	case BytesWritten:
+		p.written += e.N
+	}
+	p.last = e
+}
+
+func TestProgress(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	var size int64
+	for _, f := range files {
+		size += int64(len(f.content))
+	}
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	tests := []struct {
+		car    *Car
+		create func() (int, error)
+		name   string
+	}{
+		{&newT.Car, func() (int, error) { return newT.Create(filepath.Join(tmpDir, "index")) }, newT.Name},
+		{&newZ.Car, func() (int, error) { return newZ.Create(filepath.Join(tmpDir, "index")) }, newZ.Car.Name},
+	}
+	for _, test := range tests {
+		var p progressCounter
+		test.car.Observer = &p
+		test.car.PreScan = true
+		_, err = test.create()
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		if p.started != len(files) || p.finished != len(files) {
+			t.Errorf("%s: expected %d entries to be started and finished, got %d and %d", test.name, len(files), p.started, p.finished)
+		}
+		if p.read != size {
+			t.Errorf("%s: expected %d bytes to be read, got %d", test.name, size, p.read)
+		}
+		fi, err := os.Stat(test.name)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		if p.written != fi.Size() || p.last.CompressedBytes != fi.Size() {
+			t.Errorf("%s: expected %d bytes to be written, got %d", test.name, fi.Size(), p.written)
+		}
+		if p.last.TotalFiles != len(files) || p.last.TotalBytes != size {
+			t.Errorf("%s: expected totals of %d files and %d bytes, got %d and %d", test.name, len(files), size, p.last.TotalFiles, p.last.TotalBytes)
+		}
+		if p.last.Files != len(files) || p.last.Bytes != size {
+			t.Errorf("%s: expected %d files and %d bytes, got %d and %d", test.name, len(files), size, p.last.Files, p.last.Bytes)
+		}
+		// extract
+		p = progressCounter{}
+		test.car.OutDir = filepath.Join(tmpDir, "out")
+		if test.car == &newT.Car {
+			err = newT.Extract()
+		} else {
+			err = newZ.Extract()
+		}
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		if p.finished != len(files) || p.read != size {
+			t.Errorf("%s: expected %d files and %d bytes to be extracted, got %d and %d", test.name, len(files), size, p.finished, p.read)
+		}
+	}
+}
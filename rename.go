@@ -0,0 +1,172 @@
+package carchivum
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// transform is a sed-like rewrite rule, see Car.Transform.
+type transform struct {
+	re     *regexp.Regexp
+	repl   string
+	global bool
+}
+
+// parseTransform parses a rule of the form s/regexp/replacement/flags, where
+// regexp uses the regexp package's syntax. Any character can be used as the
+// delimiter instead of '/'; it is the one after the 's'. In the replacement,
+// & is the match and \1 through \9 are the regexp's groups. The flags are
+// g, replace every match instead of only the first, and i, ignore case.
+func parseTransform(s string) (transform, error) {
+	if len(s) < 2 || s[0] != 's' {
+		return transform{}, fmt.Errorf("transform %q: expected s/regexp/replacement/", s)
+	}
+	parts, err := splitTransform(s[2:], s[1])
+	if err != nil {
+		return transform{}, fmt.Errorf("transform %q: %s", s, err)
+	}
+	var tr transform
+	expr := parts[0]
+	for _, f := range parts[2] {
+		switch f {
+		case 'g':
+			tr.global = true
+		case 'i':
+			expr = "(?i)" + expr
+		default:
+			return transform{}, fmt.Errorf("transform %q: unknown flag %q", s, f)
+		}
+	}
+	tr.re, err = regexp.Compile(expr)
+	if err != nil {
+		return transform{}, fmt.Errorf("transform %q: %s", s, err)
+	}
+	tr.repl = sedReplacement(parts[1])
+	return tr, nil
+}
+
+// splitTransform splits s into the regexp, replacement, and flags, which
+// are separated by delim. An escaped delim is part of the regexp or
+// replacement.
+func splitTransform(s string, delim byte) ([3]string, error) {
+	var parts [3]string
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			b.WriteByte(delim)
+			i++
+		case s[i] == delim && n < 2:
+			parts[n] = b.String()
+			b.Reset()
+			n++
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	if n < 2 {
+		return parts, fmt.Errorf("expected 3 %q delimiters", delim)
+	}
+	parts[2] = b.String()
+	return parts, nil
+}
+
+// sedReplacement converts a sed replacement to a regexp.Expand template.
+func sedReplacement(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] >= '0' && s[i] <= '9' {
+				fmt.Fprintf(&b, "${%c}", s[i])
+			} else if s[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(s[i])
+			}
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// apply returns name with the rule applied.
+func (tr transform) apply(name string) string {
+	if tr.global {
+		return tr.re.ReplaceAllString(name, tr.repl)
+	}
+	loc := tr.re.FindStringSubmatchIndex(name)
+	if loc == nil {
+		return name
+	}
+	b := tr.re.ExpandString(nil, tr.repl, name, loc)
+	return name[:loc[0]] + string(b) + name[loc[1]:]
+}
+
+// setTransforms parses the Transform rules.
+func (c *Car) setTransforms() error {
+	c.transforms = c.transforms[:0]
+	for _, s := range c.Transform {
+		tr, err := parseTransform(s)
+		if err != nil {
+			return err
+		}
+		c.transforms = append(c.transforms, tr)
+	}
+	return nil
+}
+
+// rename applies the Transform rules to name. The result is cleaned; it is
+// empty if the rules removed the whole name.
+func (c *Car) rename(name string) string {
+	for _, tr := range c.transforms {
+		name = tr.apply(name)
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return name
+}
+
+// memberName returns the name, in the archive being created, of the file
+// named name: the Transform rules are applied and the Prefix is prepended.
+// An empty name means the file isn't archived.
+func (c *Car) memberName(name string) string {
+	if len(c.transforms) == 0 && c.Prefix == "" {
+		return name
+	}
+	name = c.rename(name)
+	if name == "" {
+		return ""
+	}
+	return path.Join(c.Prefix, name)
+}
+
+// extractName returns the name, relative to OutDir, the member named name
+// is extracted to: StripComponents leading elements are removed and the
+// Transform rules are applied. An empty name means the member isn't
+// extracted.
+func (c *Car) extractName(name string) string {
+	if len(c.transforms) == 0 && c.StripComponents == 0 {
+		return name
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for i := 0; i < c.StripComponents && name != ""; i++ {
+		j := strings.IndexByte(name, '/')
+		if j < 0 {
+			return ""
+		}
+		name = name[j+1:]
+	}
+	if name == "" {
+		return ""
+	}
+	return c.rename(name)
+}
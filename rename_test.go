@@ -0,0 +1,119 @@
+package carchivum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		rule     string
+		name     string
+		expected string
+		err      string
+	}{
+		{"s/a/b/", "a/a.txt", "b/a.txt", ""},
+		{"s/a/b/g", "a/a.txt", "b/b.txt", ""},
+		{"s,^project-[^/]*/,app/,", "project-1.2.3/src/main.go", "app/src/main.go", ""},
+		{`s/\(x\)/y/`, "(x)", "y", ""},
+		{`s/[a-z]*\.txt$/&.bak/`, "dir/notes.txt", "dir/notes.txt.bak", ""},
+		{`s/([a-z]+)-([0-9]+)/\2-\1/`, "file-42", "42-file", ""},
+		{`s|/|\||g`, "a/b", "a|b", ""},
+		{"s/README/readme/i", "docs/ReadMe.md", "docs/readme.md", ""},
+		{"s/x/$1/", "x", "$1", ""},
+		{"s/a/b", "", "", "expected 3"},
+		{"y/a/b/", "", "", "expected s/"},
+		{"s/a/b/q", "", "", "unknown flag"},
+		{"s/(/b/", "", "", "missing closing"},
+	}
+	for _, test := range tests {
+		tr, err := parseTransform(test.rule)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error to contain %q, got %v", test.rule, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.rule, err)
+			continue
+		}
+		name := tr.apply(test.name)
+		if name != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.rule, test.expected, name)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newT := NewTar(filepath.Join(tmpDir, "project.tgz"))
+	newT.Prefix = "project-1.2.3"
+	newT.Transform = []string{`s,^test/dir/,test/sub/,`, `s,^test/test2\.txt$,,`}
+	cnt, err := newT.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// the test dir and 3 files
+	if cnt != 4 {
+		t.Errorf("Expected a count of 4, got %d", cnt)
+	}
+	newZ := NewZip(filepath.Join(tmpDir, "project.zip"))
+	newZ.Prefix = "project-1.2.3"
+	newZ.Transform = newT.Transform
+	_, err = newZ.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	for _, archive := range []string{newT.Name, newZ.Car.Name} {
+		dst := filepath.Join(tmpDir, "out")
+		var err error
+		if filepath.Ext(archive) == ".zip" {
+			z := NewZip(archive)
+			z.OutDir = dst
+			z.StripComponents = 1
+			z.Transform = []string{"s/^test/app/"}
+			err = z.Extract()
+		} else {
+			tb := NewTar(archive)
+			tb.OutDir = dst
+			tb.StripComponents = 1
+			tb.Transform = []string{"s/^test/app/"}
+			err = tb.Extract()
+		}
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", archive, err)
+			continue
+		}
+		expected := map[string]string{
+			"app/test1.txt":     "some content\n",
+			"app/sub/test1.txt": "different content\n",
+			"app/sub/test2.txt": "might be different content\n",
+		}
+		for name, content := range expected {
+			b, err := ioutil.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", archive, err)
+				continue
+			}
+			if string(b) != content {
+				t.Errorf("%s: %s: expected %q, got %q", archive, name, content, b)
+			}
+		}
+		_, err = os.Stat(filepath.Join(dst, "app/test2.txt"))
+		if err == nil {
+			t.Errorf("%s: expected test2.txt to not be archived", archive)
+		}
+		os.RemoveAll(dst)
+	}
+}
@@ -0,0 +1,117 @@
+package carchivum
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A Reproducible archive is byte-identical to any other created from files
+// with the same names and content, so that it can be compared, cached, or
+// verified, by its digest:
+//
+//	the entries are sorted by name, instead of being in walk order
+//	modification times are truncated to the second, and clamped to the
+//	SourceDateEpoch, if there is one
+//	the owner and group ids are 0, unless Owner or Group is set, and the
+//	owner and group names are not stored
+//	file permissions are 0755 for files that are executable by anyone and
+//	0644 for all others, unless FileMode is set
+//
+// The gzip headers of compressed tarballs never have a modification time.
+// Encrypted archives are never reproducible as each has a random salt.
+
+// pendingEntry is a file of a Reproducible archive that hasn't been opened.
+type pendingEntry struct {
+	e    *entry
+	open func() (fs.File, error)
+}
+
+// sendPending sorts the pending entries by name and sends them, in order,
+// to the writer goroutine.
+func (c *Car) sendPending() error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].e.Name < pending[j].e.Name })
+	for _, p := range pending {
+		f, err := p.open()
+		if err != nil {
+			err = c.failed(p.e.Name, err)
+			if err != nil {
+				return err
+			}
+			c.uncount(p.e)
+			continue
+		}
+		p.e.file = f
+		fi, err := p.e.contentInfo(p.e.info)
+		if err != nil {
+			p.e.close()
+			err = c.failed(p.e.Name, err)
+			if err != nil {
+				return err
+			}
+			c.uncount(p.e)
+			continue
+		}
+		// the content the Hook substituted is counted instead.
+		c.mu.Lock()
+		c.bytes += fi.Size() - p.e.info.Size()
+		p.e.info = fi
+		c.mu.Unlock()
+		err = c.send(p.e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEpoch sets the SourceDateEpoch from the SOURCE_DATE_EPOCH environment
+// variable if it hasn't been set.
+func (c *Car) setEpoch() error {
+	if !c.SourceDateEpoch.IsZero() {
+		return nil
+	}
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %s", v, err)
+	}
+	c.SourceDateEpoch = time.Unix(sec, 0)
+	return nil
+}
+
+// modTime returns the modification time to archive for a file modified at
+// t; for Reproducible archives it is truncated and clamped.
+func (c *Car) modTime(t time.Time) time.Time {
+	if !c.Reproducible {
+		return t
+	}
+	t = t.Truncate(time.Second)
+	if !c.SourceDateEpoch.IsZero() && t.After(c.SourceDateEpoch) {
+		t = c.SourceDateEpoch.Truncate(time.Second)
+	}
+	return t.UTC()
+}
+
+// perm returns the permissions to archive for a file with mode m.
+func (c *Car) perm(m fs.FileMode) fs.FileMode {
+	switch {
+	case c.FileMode > 0:
+		return c.FileMode
+	case !c.Reproducible:
+		return m.Perm()
+	case m&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
@@ -0,0 +1,92 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReproducible(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		tmpDir, err := CreateTempFiles()
+		defer RemoveTmpDir(tmpDir)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		dirs = append(dirs, tmpDir)
+	}
+	// the second copy has different times and permissions.
+	later := time.Now().Add(time.Hour)
+	for _, f := range TestFiles {
+		p := filepath.Join(dirs[1], f.name)
+		err := os.Chtimes(p, later, later)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		err = os.Chmod(p, 0700)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	epoch := time.Unix(1000000000, 0)
+	var tgz, zipped [2]bytes.Buffer
+	for i, dir := range dirs {
+		newT := NewTar("")
+		newT.Reproducible = true
+		newZ := NewZip("")
+		newZ.Reproducible = true
+		if i == 0 {
+			newT.SourceDateEpoch = epoch
+			newZ.SourceDateEpoch = epoch
+		} else {
+			t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+		}
+		_, err := newT.CreateTo(&tgz[i], filepath.Join(dir, "test"))
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		_, err = newZ.CreateTo(&zipped[i], filepath.Join(dir, "test"))
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	if !bytes.Equal(tgz[0].Bytes(), tgz[1].Bytes()) {
+		t.Error("Expected the tarballs to be identical")
+	}
+	if !bytes.Equal(zipped[0].Bytes(), zipped[1].Bytes()) {
+		t.Error("Expected the zips to be identical")
+	}
+	gr, err := gzip.NewReader(&tgz[0])
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tr := tar.NewReader(gr)
+	var last string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name < last {
+			t.Errorf("Expected %s to be before %s", hdr.Name, last)
+		}
+		last = hdr.Name
+		if !hdr.ModTime.Equal(epoch) || hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Mode != 0755 {
+			t.Errorf("%s: unexpected header %v %d %d %q %o", hdr.Name, hdr.ModTime, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Mode)
+		}
+	}
+	if last == "" {
+		t.Error("Expected the tarball to have entries")
+	}
+}
@@ -0,0 +1,94 @@
+package carchivum
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localName returns whether name, a slash separated path, stays within the
+// directory it is relative to; absolute names are relative to it too.
+func localName(name string) bool {
+	name = path.Clean(name)
+	return name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// safePath returns the path in OutDir of name, the slash separated name of
+// the entry, entry, once the StripComponents and Transform rules have been
+// applied. Nothing is extracted outside of OutDir, or through a symlink: if
+// name isn't within OutDir, or any of its parents in OutDir, or, for a
+// directory, the directory itself, is a symlink, an *fs.PathError for
+// ErrUnsafePath is returned. Checking each parent, instead of the cleaned
+// name, means that a chain of symlinks extracted earlier, e.g. "a/l -> .."
+// and "a/l/m -> ..", can't be used to write outside of OutDir.
+func (c *Car) safePath(entry, name string, isDir bool) (string, error) {
+	name = filepath.ToSlash(name)
+	if !localName(name) {
+		return "", &fs.PathError{Op: "extract", Path: entry, Err: ErrUnsafePath}
+	}
+	elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if !isDir {
+		elems = elems[:len(elems)-1]
+	}
+	p := c.OutDir
+	for _, e := range elems {
+		if e == "" {
+			continue
+		}
+		p = filepath.Join(p, e)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// nor do any of its children
+				break
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", &fs.PathError{Op: "extract", Path: entry, Err: ErrUnsafePath}
+		}
+	}
+	return filepath.Join(c.OutDir, filepath.FromSlash(name)), nil
+}
+
+// maxLinkLen is the length of the longest symlink target that is extracted
+// from a zip; a zip's symlink entries hold their target as their content.
+const maxLinkLen = 4096
+
+// extractSymlink creates fname, the symlink named name in OutDir, for the
+// entry, entry, modified at modTime, that points to target. Targets that are
+// absolute, or that point outside of OutDir, are unsafe; as the symlink is
+// never written through, see safePath, its target can't be used to write
+// outside of OutDir either. An existing file at fname is replaced, not
+// written through.
+func (c *Car) extractSymlink(entry, fname, name, target string, modTime time.Time) error {
+	if path.IsAbs(target) || filepath.IsAbs(target) || !localName(path.Join(path.Dir(filepath.ToSlash(name)), target)) {
+		return &fs.PathError{Op: "extract", Path: entry, Err: ErrUnsafePath}
+	}
+	err := c.mkdirAll(filepath.Dir(fname), 0744)
+	if err != nil {
+		return err
+	}
+	keep, err := c.keepExisting(fname, modTime)
+	if err != nil || keep {
+		return err
+	}
+	err = c.replace(fname)
+	if err != nil {
+		return err
+	}
+	// a regular file isn't removed by replace.
+	err = os.Remove(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Symlink(target, fname)
+	if err != nil {
+		return err
+	}
+	c.extractedFile(fname)
+	return nil
+}
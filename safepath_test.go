@@ -0,0 +1,196 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafePath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"absolute symlink", []*tar.Header{
+			{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		}},
+		{"escaping symlink", []*tar.Header{
+			{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: "../../evil"},
+		}},
+		{"chained symlinks", []*tar.Header{
+			{Name: "a/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/l/m", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/l/m/evil", Typeflag: tar.TypeReg, Size: 4},
+		}},
+		{"through a symlink", []*tar.Header{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l/evil", Typeflag: tar.TypeReg, Size: 4},
+		}},
+		{"directory symlink", []*tar.Header{
+			{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "d/", Typeflag: tar.TypeDir, Mode: 0700},
+		}},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, hdr := range test.headers {
+			hdr.Mode |= 0644
+			tw.WriteHeader(hdr)
+			if hdr.Size > 0 {
+				tw.Write([]byte("evil"))
+			}
+		}
+		tw.Close()
+		newT := NewTar("")
+		newT.OutDir = filepath.Join(tmpDir, "out", "dir")
+		err = newT.ExtractTar(&b)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected an unsafe path error, got %v", test.name, err)
+		}
+		for _, name := range []string{"evil", filepath.Join("out", "evil"), filepath.Join("out", "dir", "evil")} {
+			_, err = os.Stat(filepath.Join(tmpDir, name))
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: expected %s not to be extracted, got %v", test.name, name, err)
+			}
+		}
+		os.RemoveAll(filepath.Join(tmpDir, "out"))
+	}
+	// an existing symlink is replaced, not written through
+	outDir := filepath.Join(tmpDir, "out")
+	err = os.MkdirAll(outDir, 0755)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = os.Symlink(filepath.Join(tmpDir, "target"), filepath.Join(outDir, "f"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	var b bytes.Buffer
+	err = writeTestTar(&b, []testFile{{name: "f", content: []byte("content")}})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newT := NewTar("")
+	newT.OutDir = outDir
+	err = newT.ExtractTar(&b)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "target"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the symlink's target not to be written, got %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(outDir, "f"))
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("Expected f to be a regular file, got %v", err)
+	}
+}
+
+func TestZipSymlinks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// a symlink is archived, and extracted, as a symlink
+	src := filepath.Join(tmpDir, "src")
+	err = os.MkdirAll(src, 0755)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte("content"), 0644)
+	err = os.Symlink("file.txt", filepath.Join(src, "link"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	newZ.Types = DefaultTypes | TypeSymlink
+	newZ.Hash = crypto.SHA256
+	_, err = newZ.Create(src)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newZ.OutDir = filepath.Join(tmpDir, "out")
+	newZ.VerifyDigests = true
+	err = newZ.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	target, err := os.Readlink(filepath.Join(newZ.OutDir, "src", "link"))
+	if err != nil || target != "file.txt" {
+		t.Errorf("Expected src/link to be a symlink to file.txt, got %q, %v", target, err)
+	}
+	// unsafe symlinks aren't extracted
+	tests := []struct {
+		name  string
+		files []testFile
+	}{
+		{"absolute symlink", []testFile{{name: "passwd", content: []byte("/etc/passwd")}}},
+		{"escaping symlink", []testFile{{name: "a/up", content: []byte("../../evil")}}},
+		{"chained symlinks", []testFile{
+			{name: "a/l", content: []byte("..")},
+			{name: "a/l/m", content: []byte("..")},
+			{name: "a/l/m/evil", content: []byte("evil")},
+		}},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for _, f := range test.files {
+			hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+			hdr.SetMode(0644)
+			if f.name != "a/l/m/evil" {
+				hdr.SetMode(os.ModeSymlink | 0777)
+			}
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+				return
+			}
+			w.Write(f.content)
+		}
+		zw.Close()
+		for _, streamed := range []bool{false, true} {
+			newZ := NewZip("")
+			newZ.OutDir = filepath.Join(tmpDir, "zip", "dir")
+			if streamed {
+				err = newZ.ExtractReader(bytes.NewReader(b.Bytes()))
+			} else {
+				err = newZ.ExtractReaderAt(bytes.NewReader(b.Bytes()), int64(b.Len()))
+			}
+			// a streamed symlink is a regular file, see ExtractReader.
+			if !streamed && !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("%s: streamed %t: expected an unsafe path error, got %v", test.name, streamed, err)
+			}
+			for _, name := range []string{"evil", filepath.Join("zip", "evil"), filepath.Join("zip", "dir", "evil")} {
+				_, err = os.Stat(filepath.Join(tmpDir, name))
+				if !os.IsNotExist(err) {
+					t.Errorf("%s: streamed %t: expected %s not to be extracted, got %v", test.name, streamed, name, err)
+				}
+			}
+			os.RemoveAll(filepath.Join(tmpDir, "zip"))
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package carchivum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	magicnum "github.com/mohae/magicnum/compress"
+	"github.com/pierrec/lz4"
+)
+
+// A seekable tarball is a gzip, or lz4, compressed tarball whose compressor
+// is restarted, at entry boundaries or every RestartSpan bytes, so that it
+// is a series of independent gzip members, or lz4 frames, followed by its
+// Index, see WriteTo, and a fixed-size footer. A file can be read from it by
+// reading the footer, then the index, then only the member the file starts
+// in, and the ones after it, up to the end of the file.
+//
+// The index and footer are stored so that decompressors, and tar, ignore
+// them. For gzip, they are in the extra field of empty gzip members: the
+// index is split across members whose extra field has a "CX" subfield, and
+// the footer is a member whose extra field has a "CF" subfield holding the
+// offset and length of the index's members:
+//
+//	header     12 bytes  ID1 ID2 CM FLG(FEXTRA) MTIME XFL OS XLEN
+//	subfield   20 bytes  'C' 'F' LEN(16), the little-endian uint64 offset and length
+//	deflate     2 bytes  an empty final block
+//	trailer     8 bytes  CRC32 and ISIZE, both 0
+//
+// For lz4, they are in skippable frames whose data starts with "CARX", for
+// the index, or "CARF", for the footer, which is followed by the offset and
+// length of the index's frames.
+const (
+	seekableGzipFooterLen = 42
+	seekableLZ4FooterLen  = 28
+	// the largest amount of the index in one member.
+	seekableChunk = 65535 - 4
+	// the magic of the skippable frames
+	seekableLZ4Magic = lz4SkippableMagic | 0xc
+)
+
+var (
+	seekableIndexID  = [2]byte{'C', 'X'}
+	seekableFooterID = [2]byte{'C', 'F'}
+)
+
+// seekWriter writes a compressed stream as a series of independent gzip
+// members, or lz4 frames. The start of each is recorded as a checkpoint in
+// the index.
+type seekWriter struct {
+	w      io.Writer
+	format magicnum.Format
+	zw     io.WriteCloser
+	// in counts the compressed bytes written to w.
+	in *countWriter
+	x  *Index
+	// span is the amount of uncompressed data after which the compressor is
+	// restarted; out is the amount written and last is the amount written
+	// when the compressor was last restarted.
+	span, out, last int64
+}
+
+func (s *seekWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		b := p
+		if s.span > 0 {
+			if s.out-s.last >= s.span {
+				err := s.restart()
+				if err != nil {
+					return n - len(p), err
+				}
+			}
+			if room := s.last + s.span - s.out; int64(len(b)) > room {
+				b = b[:room]
+			}
+		}
+		if s.zw == nil {
+			s.zw = newCompressor(s.w, s.format)
+			s.x.checkpoints = append(s.x.checkpoints, checkpoint{in: int64(*s.in), out: s.out, member: true})
+		}
+		_, err := s.zw.Write(b)
+		if err != nil {
+			return n - len(p), err
+		}
+		s.out += int64(len(b))
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+// restart ends the current member, or frame; the next one starts with the
+// next write.
+func (s *seekWriter) restart() error {
+	s.last = s.out
+	if s.zw == nil {
+		return nil
+	}
+	err := s.zw.Close()
+	s.zw = nil
+	return err
+}
+
+func newCompressor(w io.Writer, format magicnum.Format) io.WriteCloser {
+	if format == magicnum.LZ4 {
+		return lz4.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// createSeekable writes the tarball to w as a seekable tarball.
+func (t *Tar) createSeekable(w io.Writer) error {
+	if t.Format != magicnum.GZip && t.Format != magicnum.LZ4 {
+		return fmt.Errorf("%s compressed tarballs can't be seekable: %w", t.Format, ErrUnsupportedFormat)
+	}
+	var size countWriter
+	w = io.MultiWriter(w, &size)
+	t.index = &Index{Format: t.Format}
+	sw := &seekWriter{w: w, format: t.Format, in: &size, x: t.index, span: t.RestartSpan}
+	t.indexer = &tarIndexer{x: t.index, sw: sw}
+	defer func() { t.indexer = nil }()
+	err := t.writeTar(sw)
+	if err != nil {
+		return err
+	}
+	err = sw.restart()
+	if err != nil {
+		return err
+	}
+	// the trailing index and footer
+	var buf bytes.Buffer
+	_, err = t.index.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	offset := int64(size)
+	for b := buf.Bytes(); len(b) > 0; {
+		n := len(b)
+		if n > seekableChunk {
+			n = seekableChunk
+		}
+		_, err = w.Write(seekableFrame(t.Format, seekableIndexID, b[:n]))
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	var loc [16]byte
+	binary.LittleEndian.PutUint64(loc[:], uint64(offset))
+	binary.LittleEndian.PutUint64(loc[8:], uint64(int64(size)-offset))
+	_, err = w.Write(seekableFrame(t.Format, seekableFooterID, loc[:]))
+	if err != nil {
+		return err
+	}
+	t.index.Size = int64(size)
+	return nil
+}
+
+// seekableFrame returns an empty gzip member, or an lz4 skippable frame,
+// holding data.
+func seekableFrame(format magicnum.Format, id [2]byte, data []byte) []byte {
+	if format == magicnum.LZ4 {
+		b := binary.LittleEndian.AppendUint32(nil, seekableLZ4Magic)
+		b = binary.LittleEndian.AppendUint32(b, uint32(4+len(data)))
+		b = append(b, "CAR"...)
+		b = append(b, id[1])
+		return append(b, data...)
+	}
+	b := []byte{0x1f, 0x8b, 8, 0x04, 0, 0, 0, 0, 0, 255}
+	b = binary.LittleEndian.AppendUint16(b, uint16(4+len(data)))
+	b = append(b, id[:]...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	b = append(b, data...)
+	// an empty final fixed block, then the CRC32 and size of nothing.
+	return append(b, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// seekableData returns the data of the seekable frame, with the id, at the
+// start of b, and the frame's length.
+func seekableData(format magicnum.Format, id [2]byte, b []byte) ([]byte, int, error) {
+	invalid := fmt.Errorf("invalid seekable tarball frame")
+	if format == magicnum.LZ4 {
+		if len(b) < 12 || binary.LittleEndian.Uint32(b) != seekableLZ4Magic {
+			return nil, 0, invalid
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n < 4 || 8+n > len(b) || string(b[8:11]) != "CAR" || b[11] != id[1] {
+			return nil, 0, invalid
+		}
+		return b[12 : 8+n], 8 + n, nil
+	}
+	if len(b) < 16 || !bytes.Equal(b[:4], []byte{0x1f, 0x8b, 8, 0x04}) {
+		return nil, 0, invalid
+	}
+	xlen := int(binary.LittleEndian.Uint16(b[10:]))
+	n := int(binary.LittleEndian.Uint16(b[14:]))
+	if b[12] != id[0] || b[13] != id[1] || xlen != 4+n || 12+xlen+10 > len(b) {
+		return nil, 0, invalid
+	}
+	return b[16 : 16+n], 12 + xlen + 10, nil
+}
+
+// IsSeekable reports whether the tarball, of size bytes, read from r is a
+// seekable tarball, see Tar.Seekable.
+func IsSeekable(r io.ReaderAt, size int64) (bool, error) {
+	_, _, _, err := seekableFooter(r, size)
+	if err == errNotSeekable {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+var errNotSeekable = fmt.Errorf("not a seekable tarball")
+
+// seekableFooter returns the format of the seekable tarball, of size bytes,
+// read from r, and the offset and length of its index.
+func seekableFooter(r io.ReaderAt, size int64) (magicnum.Format, int64, int64, error) {
+	for _, v := range []struct {
+		format magicnum.Format
+		n      int64
+	}{
+		{magicnum.GZip, seekableGzipFooterLen},
+		{magicnum.LZ4, seekableLZ4FooterLen},
+	} {
+		if size < v.n {
+			continue
+		}
+		b := make([]byte, v.n)
+		_, err := r.ReadAt(b, size-v.n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		data, _, err := seekableData(v.format, seekableFooterID, b)
+		if err != nil || len(data) != 16 {
+			continue
+		}
+		offset := int64(binary.LittleEndian.Uint64(data))
+		n := int64(binary.LittleEndian.Uint64(data[8:]))
+		if offset < 0 || n < 0 || offset+n != size-v.n {
+			return 0, 0, 0, fmt.Errorf("invalid seekable tarball footer")
+		}
+		return v.format, offset, n, nil
+	}
+	return 0, 0, 0, errNotSeekable
+}
+
+// ReadSeekableIndex reads the index of the seekable tarball, of size bytes,
+// read from r; only the tarball's footer and index are read, so r can be,
+// e.g., a remote file that is read using range requests. The index can be
+// used to read the tarball's files, see Index.Open.
+func ReadSeekableIndex(r io.ReaderAt, size int64) (*Index, error) {
+	format, offset, n, err := seekableFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = r.ReadAt(b, offset)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for len(b) > 0 {
+		data, l, err := seekableData(format, seekableIndexID, b)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		b = b[l:]
+	}
+	x, err := ReadIndex(&buf)
+	if err != nil {
+		return nil, err
+	}
+	x.Size = size
+	return x, nil
+}
@@ -0,0 +1,92 @@
+package carchivum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeekableTar(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	tests := []struct {
+		restartSpan int64
+		members     int
+	}{
+		// a member per entry
+		{0, len(files)},
+		// members that start mid-entry
+		{100000, 2},
+	}
+	for _, test := range tests {
+		newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+		newT.Seekable = true
+		newT.RestartSpan = test.restartSpan
+		_, err = newT.Create(filepath.Join(tmpDir, "index"))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", test.restartSpan, err)
+			continue
+		}
+		tgz, err := ioutil.ReadFile(newT.Name)
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", test.restartSpan, err)
+			continue
+		}
+		r := bytes.NewReader(tgz)
+		seekable, err := IsSeekable(r, r.Size())
+		if err != nil || !seekable {
+			t.Errorf("%d: expected the tarball to be seekable, got %t %v", test.restartSpan, seekable, err)
+			continue
+		}
+		x, err := ReadSeekableIndex(r, r.Size())
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", test.restartSpan, err)
+			continue
+		}
+		if len(x.checkpoints) < test.members {
+			t.Errorf("%d: expected at least %d checkpoints, got %d", test.restartSpan, test.members, len(x.checkpoints))
+		}
+		for _, c := range x.checkpoints {
+			if !c.member || (test.restartSpan > 0 && c.out%test.restartSpan != 0) {
+				t.Errorf("%d: unexpected checkpoint at %d", test.restartSpan, c.out)
+			}
+		}
+		checkIndex(t, "seekable", x, r, r.Size(), files)
+		// it can be extracted as usual
+		dst := filepath.Join(tmpDir, "out")
+		err = Extract(dst, newT.Name)
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", test.restartSpan, err)
+			continue
+		}
+		for _, f := range files {
+			b, err := ioutil.ReadFile(filepath.Join(dst, "index", filepath.Base(f.name)))
+			if err != nil {
+				t.Errorf("%d: expected error to be nil, got %q", test.restartSpan, err)
+				continue
+			}
+			if !bytes.Equal(b, f.content) {
+				t.Errorf("%d: %s: content didn't match", test.restartSpan, f.name)
+			}
+		}
+		os.RemoveAll(dst)
+	}
+	// a tarball that isn't seekable
+	var buf bytes.Buffer
+	_, err = NewTar("").CreateTo(&buf, filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	seekable, err := IsSeekable(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || seekable {
+		t.Errorf("Expected the tarball to not be seekable, got %t %v", seekable, err)
+	}
+}
@@ -0,0 +1,140 @@
+package carchivum
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// FileType is a set of file types, see Car.Types.
+type FileType uint
+
+// The file types that can be selected.
+const (
+	TypeRegular FileType = 1 << iota
+	TypeDir
+	TypeSymlink
+	// TypeDevice is both character and block devices.
+	TypeDevice
+	TypeNamedPipe
+)
+
+// DefaultTypes are the types of files that are archived if Car.Types isn't
+// set.
+const DefaultTypes = TypeRegular | TypeDir
+
+// fileType returns the type of a file with mode m; it is 0 for types that
+// can't be archived, e.g. sockets.
+func fileType(m fs.FileMode) FileType {
+	switch {
+	case m.IsRegular():
+		return TypeRegular
+	case m.IsDir():
+		return TypeDir
+	case m&fs.ModeSymlink != 0:
+		return TypeSymlink
+	case m&fs.ModeDevice != 0:
+		return TypeDevice
+	case m&fs.ModeNamedPipe != 0:
+		return TypeNamedPipe
+	}
+	return 0
+}
+
+// specialFile is a symlink, device, or named pipe that is queued to be
+// archived. It isn't opened, its entry in the archive has no content.
+type specialFile struct {
+	info fs.FileInfo
+	// link is a symlink's target.
+	link string
+}
+
+func (f *specialFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *specialFile) Read([]byte) (int, error)   { return 0, io.EOF }
+func (f *specialFile) Close() error               { return nil }
+
+// openSpecial returns the specialFile for the file at p.
+func openSpecial(p string, fi fs.FileInfo) (fs.File, error) {
+	f := &specialFile{info: fi}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		f.link, err = os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// setSelection resolves the IncludeOwner and IncludeGroup.
+func (c *Car) setSelection() error {
+	if c.IncludeOwner != "" {
+		id := c.IncludeOwner
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(id)
+			if err != nil {
+				return fmt.Errorf("owner: %s", err)
+			}
+			id = u.Uid
+		}
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("owner %s: %s isn't a numeric id", c.IncludeOwner, id)
+		}
+		c.uid = uid
+	}
+	if c.IncludeGroup != "" {
+		id := c.IncludeGroup
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(id)
+			if err != nil {
+				return fmt.Errorf("group: %s", err)
+			}
+			id = g.Gid
+		}
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("group %s: %s isn't a numeric id", c.IncludeGroup, id)
+		}
+		c.gid = gid
+	}
+	return nil
+}
+
+// selectFile returns whether the file's type, size, owner, and permissions
+// match the selection predicates.
+func (c *Car) selectFile(fi fs.FileInfo) bool {
+	types := c.Types
+	if types == 0 {
+		types = DefaultTypes
+	}
+	typ := fileType(fi.Mode())
+	if typ&types == 0 {
+		return false
+	}
+	if typ == TypeDir {
+		return true
+	}
+	if typ == TypeRegular {
+		if c.MinSize > 0 && fi.Size() < c.MinSize {
+			return false
+		}
+		if c.MaxSize > 0 && fi.Size() > c.MaxSize {
+			return false
+		}
+	}
+	perm := fi.Mode().Perm()
+	if perm&c.IncludePerm != c.IncludePerm || perm&c.ExcludePerm != 0 {
+		return false
+	}
+	if c.IncludeOwner != "" || c.IncludeGroup != "" {
+		uid, gid, ok := fileOwner(fi)
+		if !ok || (c.IncludeOwner != "" && uid != c.uid) || (c.IncludeGroup != "" && gid != c.gid) {
+			return false
+		}
+	}
+	return true
+}
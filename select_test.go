@@ -0,0 +1,124 @@
+package carchivum
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSelectFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	files := []struct {
+		name string
+		size int
+		perm os.FileMode
+	}{
+		{"src/small.log", 10, 0644},
+		{"src/big.log", 2000, 0644},
+		{"src/dir/run.sh", 100, 0755},
+	}
+	for _, f := range files {
+		p := filepath.Join(tmpDir, f.name)
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		err = ioutil.WriteFile(p, bytes.Repeat([]byte("x"), f.size), f.perm)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		err = os.Chmod(p, f.perm)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	err = os.Symlink("dir/run.sh", filepath.Join(tmpDir, "src/run"))
+	if err != nil {
+		t.Skipf("symlinks aren't supported: %s", err)
+	}
+	uid := strconv.Itoa(os.Getuid())
+	tests := []struct {
+		name     string
+		set      func(c *Car)
+		expected []string
+	}{
+		{"default", func(c *Car) {}, []string{"src/big.log", "src/dir/run.sh", "src/small.log"}},
+		{"min size", func(c *Car) { c.MinSize = 1000 }, []string{"src/big.log"}},
+		{"max size", func(c *Car) { c.MaxSize = 1000 }, []string{"src/dir/run.sh", "src/small.log"}},
+		{"symlinks", func(c *Car) { c.Types = TypeSymlink }, []string{"src/run"}},
+		{"all", func(c *Car) { c.Types = DefaultTypes | TypeSymlink }, []string{"src/big.log", "src/dir/run.sh", "src/run", "src/small.log"}},
+		{"include perm", func(c *Car) { c.IncludePerm = 0100 }, []string{"src/dir/run.sh"}},
+		{"exclude perm", func(c *Car) { c.ExcludePerm = 0111 }, []string{"src/big.log", "src/small.log"}},
+		{"owner", func(c *Car) { c.IncludeOwner = uid; c.MinSize = 1000 }, []string{"src/big.log"}},
+		{"other owner", func(c *Car) { c.IncludeOwner = "4242424" }, nil},
+		{"one file system", func(c *Car) { c.OneFileSystem = true }, []string{"src/big.log", "src/dir/run.sh", "src/small.log"}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		newT := NewTar("")
+		test.set(&newT.Car)
+		_, err = newT.CreateTo(&buf, filepath.Join(tmpDir, "src"))
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		gr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		tr := tar.NewReader(gr)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+				break
+			}
+			names = append(names, hdr.Name)
+			if hdr.Name == "src/run" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "dir/run.sh") {
+				t.Errorf("%s: expected a symlink to dir/run.sh, got %c %q", test.name, hdr.Typeflag, hdr.Linkname)
+			}
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, names)
+		}
+	}
+	// the symlink is extracted as a symlink
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.Types = DefaultTypes | TypeSymlink
+	_, err = newT.Create(filepath.Join(tmpDir, "src"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = Extract(filepath.Join(tmpDir, "out"), newT.Name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	link, err := os.Readlink(filepath.Join(tmpDir, "out/src/run"))
+	if err != nil || link != "dir/run.sh" {
+		t.Errorf("Expected a symlink to dir/run.sh, got %q %v", link, err)
+	}
+}
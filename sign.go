@@ -0,0 +1,78 @@
+package carchivum
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SigExt is the extension of an archive's detached signature file. The
+// signature of archive.tgz is archive.tgz.sig.
+const SigExt = ".sig"
+
+// Archives are signed using Ed25519ph so that they can be hashed as they are
+// read instead of having to be held in memory.
+var sigOpts = &ed25519.Options{Hash: crypto.SHA512, Context: "carchivum"}
+
+// Sign signs the named archive with key and writes the signature to a
+// detached signature file: the archive's name with SigExt appended.
+func Sign(name string, key ed25519.PrivateKey) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	digest, err := sigDigest(f)
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(nil, digest, sigOpts)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name+SigExt, sig, 0644)
+}
+
+// Verify checks the named archive against its detached signature using key.
+// An error is returned if the signature file can't be read or if it is not
+// a valid signature of the archive.
+func Verify(name string, key ed25519.PublicKey) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifySignature(f, name, key)
+}
+
+// verifySignature checks the archive read from r against the detached
+// signature of the named archive. Extraction verifies the same handle that
+// it extracts from so that the archive can't be swapped after it has been
+// verified.
+func verifySignature(r io.Reader, name string, key ed25519.PublicKey) error {
+	sig, err := os.ReadFile(name + SigExt)
+	if err != nil {
+		return err
+	}
+	digest, err := sigDigest(r)
+	if err != nil {
+		return err
+	}
+	err = ed25519.VerifyWithOptions(key, digest, sig, sigOpts)
+	if err != nil {
+		return fmt.Errorf("%s: signature verification failed: %s", name, err)
+	}
+	return nil
+}
+
+func sigDigest(r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,93 @@
+package carchivum
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected creation of temp files to result in no error, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Errorf("expected key generation to result in no error, got %q", err)
+		return
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.SignKey = priv
+	_, err = newT.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected creation of tar to result in no error, got %q", err)
+		return
+	}
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	newZ.SignKey = priv
+	_, err = newZ.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected creation of zip to result in no error, got %q", err)
+		return
+	}
+
+	for i, name := range []string{newT.Name, newZ.Car.Name} {
+		_, err = os.Stat(name + SigExt)
+		if err != nil {
+			t.Errorf("%d: expected the signature file to exist, got %q", i, err)
+			continue
+		}
+		err = Verify(name, pub)
+		if err != nil {
+			t.Errorf("%d: expected verify to result in no error, got %q", i, err)
+		}
+		err = Verify(name, otherPub)
+		if err == nil {
+			t.Errorf("%d: expected verify with the wrong key to result in an error, got none", i)
+		}
+		eDir := filepath.Join(tmpDir, "extract", filepath.Ext(name))
+		err = ExtractVerified(eDir, name, pub)
+		if err != nil {
+			t.Errorf("%d: expected verified extract to result in no error, got %q", i, err)
+		}
+		_, err = os.Stat(filepath.Join(eDir, "test/test1.txt"))
+		if err != nil {
+			t.Errorf("%d: expected the extracted file to exist, got %q", i, err)
+		}
+
+		// tamper with the archive
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Errorf("%d: expected open to result in no error, got %q", i, err)
+			continue
+		}
+		f.Write([]byte{0})
+		f.Close()
+		tDir := filepath.Join(tmpDir, "tampered", filepath.Ext(name))
+		err = ExtractVerified(tDir, name, pub)
+		if err == nil {
+			t.Errorf("%d: expected extract of a tampered archive to result in an error, got none", i)
+		}
+		_, err = os.Stat(tDir)
+		if !os.IsNotExist(err) {
+			t.Errorf("%d: expected nothing to be extracted from a tampered archive, got %v", i, err)
+		}
+	}
+	newT.OutDir = filepath.Join(tmpDir, "tampered", "tar")
+	newT.VerifyKey = pub
+	err = newT.Extract()
+	if err == nil {
+		t.Error("expected Tar.Extract of a tampered archive to result in an error, got none")
+	}
+	newZ.OutDir = filepath.Join(tmpDir, "tampered", "zip")
+	newZ.VerifyKey = pub
+	err = newZ.Extract()
+	if err == nil {
+		t.Error("expected Zip.Extract of a tampered archive to result in an error, got none")
+	}
+}
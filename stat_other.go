@@ -0,0 +1,15 @@
+//go:build !unix
+
+package carchivum
+
+import "os"
+
+// fileOwner returns false as file ownership isn't available.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileDevice returns false as the file's device isn't available.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
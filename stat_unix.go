@@ -0,0 +1,27 @@
+//go:build unix
+
+package carchivum
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the file's owner and group ids, if they are available.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileDevice returns the id of the device the file is on, if it is
+// available.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
@@ -0,0 +1,195 @@
+package carchivum
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// SkipReason is why a file wasn't archived, or extracted.
+type SkipReason string
+
+const (
+	// SkippedIgnored files match the ExcludePatterns or an ignore file.
+	SkippedIgnored SkipReason = "ignored"
+	// SkippedFiltered files don't match the include filters, or match the
+	// exclude filters.
+	SkippedFiltered SkipReason = "filtered"
+	// SkippedSelection files aren't of the selected Types, sizes, owners,
+	// or permissions.
+	SkippedSelection SkipReason = "selection"
+	// SkippedTime files weren't modified within the Newer and Older times.
+	SkippedTime SkipReason = "time"
+	// SkippedFileSystem directories are on another file system, see
+	// OneFileSystem.
+	SkippedFileSystem SkipReason = "file system"
+	// SkippedUnsupported files are of a type that can't be archived.
+	SkippedUnsupported SkipReason = "unsupported"
+	// SkippedHook files were skipped by the Hook.
+	SkippedHook SkipReason = "hook"
+	// SkippedRenamed files were renamed to nothing by the Transform rules,
+	// or, when extracting, had fewer elements than StripComponents.
+	SkippedRenamed SkipReason = "renamed"
+	// SkippedExisting files already existed and were kept, see Overwrite.
+	SkippedExisting SkipReason = "existing"
+	// SkippedFailed files failed and were skipped, see ContinueOnError.
+	SkippedFailed SkipReason = "failed"
+)
+
+// Stats are the statistics of the last operation, see Car.Stats. Skipped
+// directories aren't walked, so their content isn't counted.
+type Stats struct {
+	// Operation is "create" or "extract" and Name is the archive's name.
+	Operation string `json:"operation"`
+	Name      string `json:"name"`
+	// The number of entries, by type, that were archived or extracted.
+	Files    int `json:"files"`
+	Dirs     int `json:"dirs"`
+	Symlinks int `json:"symlinks"`
+	Other    int `json:"other"`
+	// BytesIn is the number of bytes of content read when an archive is
+	// created, or of the archive when it is extracted; BytesOut is the
+	// number of bytes of the archive that were written, or of content
+	// that was extracted. The archive bytes of a tarball extracted with
+	// ExtractMember aren't counted.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Skipped is the number of files that were skipped, by why.
+	Skipped map[SkipReason]int `json:"skipped,omitempty"`
+	// Walk is the time spent walking the sources; Read is the time spent
+	// reading the files' content, or, when extracting, reading and
+	// decompressing the entries; Compress is the time spent adding the
+	// files to the archive, less Read and Write; Write is the time spent
+	// writing the archive, or the extracted files. The phases of creating
+	// an archive overlap, so their sum can exceed Duration.
+	Walk     time.Duration `json:"walk"`
+	Read     time.Duration `json:"read"`
+	Compress time.Duration `json:"compress"`
+	Write    time.Duration `json:"write"`
+	Duration time.Duration `json:"duration"`
+	// Ratio is the number of bytes of content per byte of archive, and
+	// Throughput is the number of bytes of content processed per second.
+	Ratio      float64 `json:"compression_ratio"`
+	Throughput float64 `json:"throughput"`
+
+	start time.Time
+	// the time spent adding the files to the archive, and blocked sending
+	// them to the writer goroutine.
+	archive, blocked time.Duration
+}
+
+// MarshalJSON marshals the stats with their times in seconds.
+func (s Stats) MarshalJSON() ([]byte, error) {
+	type stats Stats
+	return json.Marshal(struct {
+		stats
+		Walk     float64 `json:"walk"`
+		Read     float64 `json:"read"`
+		Compress float64 `json:"compress"`
+		Write    float64 `json:"write"`
+		Duration float64 `json:"duration"`
+	}{stats(s), s.Walk.Seconds(), s.Read.Seconds(), s.Compress.Seconds(), s.Write.Seconds(), s.Duration.Seconds()})
+}
+
+// Stats returns the statistics of the last create, or extract, operation.
+func (c *Car) Stats() Stats {
+	s := c.stats
+	s.Skipped = make(map[SkipReason]int, len(c.stats.Skipped))
+	for k, v := range c.stats.Skipped {
+		s.Skipped[k] = v
+	}
+	content, archive := s.BytesIn, s.BytesOut
+	if s.Operation == opExtract {
+		content, archive = s.BytesOut, s.BytesIn
+	}
+	if archive > 0 {
+		s.Ratio = float64(content) / float64(archive)
+	}
+	if s.Duration > 0 {
+		s.Throughput = float64(content) / s.Duration.Seconds()
+	}
+	return s
+}
+
+const (
+	opCreate  = "create"
+	opExtract = "extract"
+)
+
+// begin resets the progress and the stats for an operation.
+func (c *Car) begin(op string) {
+	c.progress = progress{}
+	c.files, c.bytes, c.compressedBytes = 0, 0, 0
+	c.stats = Stats{Operation: op, Name: c.Name, start: time.Now()}
+	c.failures = nil
+}
+
+// finish completes the stats of the operation.
+func (c *Car) finish() {
+	s := &c.stats
+	s.Duration = time.Since(s.start)
+	if s.Operation == opCreate {
+		s.BytesIn = c.progress.bytes
+		s.BytesOut = c.compressedBytes
+		s.Compress = s.archive - s.Read - s.Write
+		if s.Compress < 0 {
+			s.Compress = 0
+		}
+		return
+	}
+	s.BytesOut = c.progress.bytes
+}
+
+// skip counts, and logs, a file, p, that was skipped; the files found by the
+// PreScan aren't counted. It is safe to call concurrently.
+func (c *Car) skip(reason SkipReason, p string) {
+	if c.progress.scanning {
+		return
+	}
+	c.debug("skipped", "path", p, "reason", string(reason))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats.Skipped == nil {
+		c.stats.Skipped = map[SkipReason]int{}
+	}
+	c.stats.Skipped[reason]++
+}
+
+// count adds n to the count of entries of type mode. Its callers
+// synchronize it.
+func (c *Car) count(mode os.FileMode, n int) {
+	switch {
+	case mode.IsRegular():
+		c.stats.Files += n
+	case mode.IsDir():
+		c.stats.Dirs += n
+	case mode&os.ModeSymlink != 0:
+		c.stats.Symlinks += n
+	default:
+		c.stats.Other += n
+	}
+}
+
+// uncount removes e, which failed, from the counts; it was counted when it
+// was queued.
+func (c *Car) uncount(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files--
+	c.bytes -= e.info.Size()
+	c.count(e.info.Mode(), -1)
+}
+
+// timedWriter adds the time spent writing to w to d.
+type timedWriter struct {
+	w io.Writer
+	d *time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	t := time.Now()
+	n, err := w.w.Write(p)
+	*w.d += time.Since(t)
+	return n, err
+}
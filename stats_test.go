@@ -0,0 +1,89 @@
+package carchivum
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	files := indexTestFiles()
+	tmpDir, err := createIndexTestFiles(files)
+	defer RemoveTmpDir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	var size int64
+	for _, f := range files[1:] {
+		size += int64(len(f.content))
+	}
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.ExcludePatterns = []string{"00.txt"}
+	newT.Hook = func(c *Candidate) (bool, error) {
+		return !strings.HasSuffix(c.Name, "01.txt"), nil
+	}
+	_, err = newT.Create(filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	size -= int64(len(files[1].content))
+	s := newT.Stats()
+	if s.Operation != "create" || s.Files != len(files)-2 {
+		t.Errorf("Expected create of %d files, got %s of %d files", len(files)-2, s.Operation, s.Files)
+	}
+	fi, err := os.Stat(newT.Name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if s.BytesIn != size || s.BytesOut != fi.Size() {
+		t.Errorf("Expected %d bytes in and %d bytes out, got %d and %d", size, fi.Size(), s.BytesIn, s.BytesOut)
+	}
+	if s.Ratio <= 1 {
+		t.Errorf("Expected a compression ratio > 1, got %f", s.Ratio)
+	}
+	if s.Skipped[SkippedIgnored] != 1 || s.Skipped[SkippedHook] != 1 {
+		t.Errorf("Expected 1 ignored and 1 hook skip, got %v", s.Skipped)
+	}
+	if s.Duration <= 0 || s.Throughput <= 0 {
+		t.Errorf("Expected a duration and throughput, got %v and %f", s.Duration, s.Throughput)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if m["duration"].(float64) != s.Duration.Seconds() || m["files"].(float64) != float64(s.Files) {
+		t.Errorf("Expected the duration in seconds and the files, got %s", b)
+	}
+	if m["skipped"].(map[string]interface{})["hook"].(float64) != 1 {
+		t.Errorf("Expected the skipped files, got %s", b)
+	}
+	// extract, twice; the second time the existing files are kept
+	newT.OutDir = filepath.Join(tmpDir, "out")
+	newT.Overwrite = SkipExisting
+	for i := 0; i < 2; i++ {
+		err = newT.Extract()
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	s = newT.Stats()
+	if s.Operation != "extract" || s.Files != 0 || s.Skipped[SkippedExisting] != len(files)-2 {
+		t.Errorf("Expected %d existing files to be skipped, got %d files and %v", len(files)-2, s.Files, s.Skipped)
+	}
+	if s.BytesIn != fi.Size() {
+		t.Errorf("Expected %d bytes in, got %d", fi.Size(), s.BytesIn)
+	}
+}
@@ -2,17 +2,18 @@ package carchivum
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/bzip2"
 	"compress/gzip"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/MichaelTJones/walk"
 	magicnum "github.com/mohae/magicnum/compress"
 	"github.com/pierrec/lz4"
 )
@@ -22,7 +23,31 @@ type Tar struct {
 	Car
 	*tar.Writer
 	magicnum.Format
-	sources []string
+	// Passphrase, if set, is used to encrypt the compressed tarball when it
+	// is created and to decrypt it when it is extracted. The encryption key
+	// is derived from it using scrypt.
+	Passphrase string
+	// EncryptionKey, if set, is the 32 byte key used to encrypt and decrypt
+	// the tarball; each tarball's encryption key is derived from it using
+	// HKDF. It is used when there isn't a Passphrase.
+	EncryptionKey []byte
+	// CreateIndex, if set, creates a random-access index of the tarball, see
+	// Index, as it is created. Create saves it to Name with IndexExt
+	// appended. Only gzip and lz4 compressed tarballs can be indexed as
+	// they are created.
+	CreateIndex bool
+	// IndexSpan is the approximate amount of uncompressed data between the
+	// index's checkpoints; if it is 0, DefaultIndexSpan is used.
+	IndexSpan int64
+	// Seekable, if set, creates a seekable tarball: its compressor is
+	// restarted every RestartSpan bytes, or at every entry if RestartSpan is
+	// 0, and its index is appended to it. It can still be decompressed, and
+	// extracted, as usual. See ReadSeekableIndex.
+	Seekable    bool
+	RestartSpan int64
+	sources     []string
+	index       *Index
+	indexer     *tarIndexer
 }
 
 // NewTar returns an initialized Tar struct ready for use.
@@ -40,58 +65,176 @@ func (t *Tar) Create(src ...string) (cnt int, err error) {
 	if len(src) == 0 {
 		return 0, fmt.Errorf("a source is required to create a tar archive")
 	}
-	t.sources = src
 	// See if we can create the destination file before processing
-	tball, err := os.OpenFile(t.Name, os.O_RDWR|os.O_CREATE, 0744)
+	tball, err := os.OpenFile(t.Name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0744)
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		cerr := tball.Close()
-		if cerr != nil && err == nil {
-			err = cerr
+	defer tball.Close()
+	cnt, err = t.CreateTo(tball, src...)
+	// the tarball is kept if some of the files failed, see ContinueOnError.
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		// remove the partial tarball
+		tball.Close()
+		os.Remove(t.Name)
+		return 0, err
+	}
+	err = tball.Close()
+	if err != nil {
+		return 0, err
+	}
+	if t.CreateIndex && t.index != nil {
+		err = t.index.WriteIndexFile(t.Name + IndexExt)
+		if err != nil {
+			return 0, err
 		}
-	}()
+	}
+	if t.SignKey != nil {
+		err = Sign(t.Name, t.SignKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// if some of the files failed, none are deleted.
+	if t.DeleteArchived && partial == nil {
+		err := t.removeFiles()
+		if err != nil {
+			return 0, fmt.Errorf("an error was encountered while deleting the archived files; some files may not be deleted: %w", err)
+		}
+	}
+	if partial != nil {
+		return cnt, partial
+	}
+	return cnt, nil
+}
+
+// CreateTo creates a compressed tarball from the passed src('s) and writes it
+// to w as it is created. If CreateIndex is set, the tarball's index is
+// available from Index once it has been created.
+func (t *Tar) CreateTo(w io.Writer, src ...string) (cnt int, err error) {
+	// If there aren't any sources, return err
+	if len(src) == 0 {
+		return 0, fmt.Errorf("a source is required to create a tar archive")
+	}
+	t.sources = src
+	t.index = nil
+	err = t.startProgress(src)
+	if err != nil {
+		return 0, err
+	}
+	defer t.finish()
+	w = t.progressWriter(w)
+	if t.Seekable {
+		if t.encrypted() {
+			return 0, fmt.Errorf("encrypted tarballs can't be seekable")
+		}
+		err = t.createSeekable(w)
+		if err != nil {
+			return 0, err
+		}
+		t.setDelta()
+		return int(t.Car.files), t.partial()
+	}
+	var size countWriter
+	var lz4Index chan error
+	if t.CreateIndex {
+		if t.encrypted() {
+			return 0, fmt.Errorf("encrypted tarballs can't be indexed")
+		}
+		w = io.MultiWriter(w, &size)
+		switch t.Format {
+		case magicnum.GZip:
+			t.index = &Index{Format: t.Format}
+			t.indexer = &tarIndexer{x: t.index, span: t.IndexSpan, in: &size}
+			if t.indexer.span <= 0 {
+				t.indexer.span = DefaultIndexSpan
+			}
+			defer func() { t.indexer = nil }()
+		case magicnum.LZ4:
+			// the lz4 frames are indexed as they are written.
+			pr, pw := io.Pipe()
+			lz4Index = make(chan error, 1)
+			go func() {
+				x, err := BuildIndex(pr, t.IndexSpan)
+				pr.CloseWithError(err)
+				t.index = x
+				lz4Index <- err
+			}()
+			w = io.MultiWriter(w, pw)
+			defer func() {
+				pw.Close()
+				ierr := <-lz4Index
+				if err == nil && ierr != nil {
+					cnt, err = 0, ierr
+				}
+			}()
+		}
+	}
+	// If the tarball is to be encrypted, encryption is layered after the
+	// compression.
+	var cw *cryptWriter
+	if t.encrypted() {
+		cw, err = t.newCryptWriter(w)
+		if err != nil {
+			return 0, err
+		}
+		w = cw
+	}
 	switch t.Format {
 	case magicnum.GZip:
-		err = t.CreateGZip(tball)
+		err = t.CreateGZip(w)
 		if err != nil {
 			return 0, err
 		}
 	case magicnum.BZip2:
-		err = fmt.Errorf("Bzip2 compression is not supported")
+		err = fmt.Errorf("bzip2 compression: %w", ErrUnsupportedFormat)
 		return 0, err
 	case magicnum.LZ4:
-		err = t.CreateLZ4(tball)
+		err = t.CreateLZ4(w)
 		if err != nil {
 			return 0, err
 		}
 	default:
-		err = fmt.Errorf("Unsupported compression format: %s", t.Format.String())
+		err = fmt.Errorf("%s compression: %w", t.Format, ErrUnsupportedFormat)
 		return 0, err
 	}
-	if t.DeleteArchived {
-		err := t.removeFiles()
+	if cw != nil {
+		err = cw.Close()
 		if err != nil {
-			return 0, fmt.Errorf("an error was encountered while deleting the archived files; some files may not be deleted: %s", err)
+			return 0, err
 		}
 	}
+	if t.indexer != nil {
+		t.index.Size = int64(size)
+	}
 	t.setDelta()
-	return int(t.Car.files), nil
+	return int(t.Car.files), t.partial()
+}
+
+// Index returns the index of the tarball that was created if CreateIndex
+// was set.
+func (t *Tar) Index() *Index {
+	return t.index
 }
 
 func (t *Tar) removeFiles() error {
+	var errs []error
 	for _, file := range t.deleteList {
 		err := os.Remove(file)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
+	if len(errs) > 0 {
+		return &PartialError{Errs: errs}
+	}
 	return nil
 }
 
 // CreateGZip creates a GZip using the passed writer.
 func (t *Tar) CreateGZip(w io.Writer) (err error) {
+	// the header's ModTime isn't set, so it doesn't have one.
 	zw := gzip.NewWriter(w)
 	// Close the file with error handling
 	defer func() {
@@ -100,6 +243,10 @@ func (t *Tar) CreateGZip(w io.Writer) (err error) {
 			err = cerr
 		}
 	}()
+	if t.indexer != nil {
+		t.indexer.zw = zw
+		return t.writeTar(io.MultiWriter(zw, &t.indexer.out))
+	}
 	err = t.writeTar(zw)
 	return err
 }
@@ -141,107 +288,188 @@ func (t *Tar) writeTar(w io.Writer) (err error) {
 			err = cerr
 		}
 	}()
-	t.FileCh = make(chan *os.File)
+	t.entries = make(chan *entry)
+	t.werr = nil
 	wait, err := t.Write()
 	if err != nil {
-		log.Print(err)
 		return err
 	}
-	var fullPath string
-	visitor := func(p string, fi os.FileInfo, err error) error {
-		return t.AddFile(fullPath, p, fi, err)
-	}
-	for _, source := range t.sources {
-		fullPath, err = filepath.Abs(source)
-		if err != nil {
-			return err
-		}
-		err = walk.Walk(fullPath, visitor)
-		if err != nil {
-			return err
-		}
-	}
-	close(t.FileCh)
+	err = t.addSources(t.sources)
+	// the writer closes any files that are still queued
+	close(t.entries)
 	wait.Wait()
-	return err
+	if err != nil {
+		return err
+	}
+	return t.werr
 }
 
-// Write adds the files received on the channel to the tarball.
+// Write adds the files received on the channel to the tarball. The first
+// error encountered is returned by Create; once an error has occurred, the
+// remaining files are closed without being added.
 func (t *Tar) Write() (*sync.WaitGroup, error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go func() error {
+	go func() {
 		defer wg.Done()
-		for f := range t.FileCh {
-			info, err := f.Stat()
-			if err != nil {
-				return err
+		for e := range t.entries {
+			if t.werr == nil {
+				t.werr = t.ctxErr()
 			}
-			if info.IsDir() {
+			if t.werr != nil {
+				e.close()
 				continue
 			}
-			header, err := tar.FileInfoHeader(info, "")
-			if err != nil {
-				return err
-			}
-			header.Name = f.Name()
-			// See if any header overrides need to be done
-			if t.Owner > 0 {
-				header.Uid = t.Owner
-			}
-			if t.Group > 0 {
-				header.Gid = t.Group
-			}
-			if t.FileMode > 0 {
-				header.Mode = int64(t.FileMode)
-			} else {
-				header.Mode = int64(info.Mode().Perm())
-			}
-			header.ModTime = info.ModTime()
-			err = t.Writer.WriteHeader(header)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(t.Writer, f)
-			if err != nil {
-				return err
-			}
-			err = f.Close()
-			if err != nil {
-				return err
+			start := time.Now()
+			t.werr = t.writeFile(e)
+			t.stats.archive += time.Since(start)
+			// the tarball is intact if the header wasn't written.
+			if t.werr != nil && !e.written {
+				t.werr = t.failed(e.Name, t.werr)
+				if t.werr == nil {
+					t.uncount(e)
+				}
 			}
 		}
-		return nil
 	}()
 	return &wg, nil
 }
 
+// writeFile adds e to the tarball and closes it. If a Hash is set, e's digest
+// is computed prior to it being added; the digest is stored in the entry's
+// PAX records.
+func (t *Tar) writeFile(e *entry) (err error) {
+	defer e.close()
+	info, err := e.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	t.entryStarted(e.Name, info.Size())
+	defer func() { t.entryFinished(e.Name, info.Size(), err) }()
+	var link string
+	if f, ok := e.file.(*specialFile); ok {
+		link = f.link
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = e.Name
+	// See if any header overrides need to be done
+	if t.Reproducible {
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	}
+	if t.Owner > 0 {
+		header.Uid = t.Owner
+	}
+	if t.Group > 0 {
+		header.Gid = t.Group
+	}
+	header.Mode = int64(t.perm(info.Mode()))
+	header.ModTime = t.modTime(info.ModTime())
+	if c := e.hook; c != nil {
+		if c.Mode != 0 {
+			header.Mode = int64(c.Mode.Perm())
+		}
+		if !c.ModTime.IsZero() {
+			header.ModTime = c.ModTime
+		}
+		if c.Uid >= 0 {
+			header.Uid = c.Uid
+		}
+		if c.Gid >= 0 {
+			header.Gid = c.Gid
+		}
+	}
+	if t.Hash != 0 && info.Mode().IsRegular() {
+		name, err := digestName(t.Hash)
+		if err != nil {
+			return err
+		}
+		f, err := e.seekable()
+		if err != nil {
+			return err
+		}
+		sum, err := fileDigest(f, t.Hash)
+		if err != nil {
+			return err
+		}
+		header.PAXRecords = map[string]string{paxDigestPrefix + name: hex.EncodeToString(sum)}
+	}
+	e.written = true
+	if t.indexer != nil {
+		err = t.indexer.entry(t.Writer, header)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.Writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.Writer, t.progressReader(t.ctxReader(e.file)))
+	return err
+}
+
 // Delete is not implemented
 func (t *Tar) Delete() error {
 	return nil
 }
 
 // Extract extracts the files from the src and writes them to the dst. The src
-// is either a tar or a compressed tar.
+// is either a tar or a compressed tar. If a VerifyKey is set, the src is
+// verified against its detached signature before anything is extracted.
 func (t *Tar) Extract() error {
 	// open the file
 	f, err := os.Open(t.Name)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	if t.VerifyKey != nil {
+		err = verifySignature(f, t.Name, t.VerifyKey)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
 	// find its format
 	t.Format, err = magicnum.GetFormat(f)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	return t.ExtractArchive(f)
 }
 
 // ExtractArchive takes a compressed tar archive, as an io.Reader.  If the compression
 // format used is supported, it will decompress and extract the contents of the tar;
-// otherwise it will return an error.
+// otherwise it will return an error. Encrypted tarballs are decrypted, using
+// the Passphrase or EncryptionKey, before they are decompressed; the Format of
+// an encrypted tarball is detected once it has been decrypted.
 func (t *Tar) ExtractArchive(src io.Reader) error {
+	br := bufio.NewReader(src)
+	b, err := br.Peek(len(cryptMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var n countWriter
+	src = io.TeeReader(br, &n)
+	// the archive's bytes are counted once ExtractTar has reset the stats.
+	defer func() { t.stats.BytesIn = int64(n) }()
+	if string(b) == cryptMagic {
+		src, err = t.decrypt(src)
+		if err != nil {
+			return err
+		}
+	}
 	switch t.Format {
 	case magicnum.Tar:
 		return t.ExtractTar(src)
@@ -252,64 +480,192 @@ func (t *Tar) ExtractArchive(src io.Reader) error {
 	case magicnum.LZ4:
 		return t.ExtractLZ4(src)
 	default:
-		return fmt.Errorf("%s is not a supported format", t.Format)
+		return fmt.Errorf("%s: %w", t.Format, ErrUnsupportedFormat)
 	}
 }
 
 // ExtractTar extracts a tar file using the passed reader
 func (t *Tar) ExtractTar(src io.Reader) (err error) {
+	t.begin(opExtract)
+	var n countWriter
+	src = io.TeeReader(src, &n)
+	defer func() {
+		t.stats.BytesIn = int64(n)
+		t.finish()
+	}()
+	err = t.setTransforms()
+	if err != nil {
+		return err
+	}
 	tr := tar.NewReader(src)
 	for {
+		err = t.ctxErr()
+		if err != nil {
+			return err
+		}
 		header, err := tr.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			// the other errors, e.g. the source's, aren't the tarball's.
+			var cerr *CorruptError
+			if !errors.As(err, &cerr) && (errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF)) {
+				err = &CorruptError{Offset: int64(n), Err: err}
+			}
 			return err
 		}
-		fname := header.Name
-		// extract is always relative to cwd, for now
-		// temporarily commented out because dst is no longer supported
-		// TODO add flag for destinatiion
-		fname = filepath.Join(t.OutDir, fname)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			err = os.MkdirAll(fname, 0744)
-			if err != nil {
-				return err
-			}
-			// set the final element to the appropriate permission
-			err = os.Chmod(fname, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			// create the parent directory if necessary
-			pdir := filepath.Dir(fname)
-			err = os.MkdirAll(pdir, 0744)
-			if err != nil {
-				return err
-			}
-			if err != nil {
-				return err
-			}
-			w, err := os.Create(fname)
+		err = t.extractEntry(header, tr)
+		if err != nil {
+			err = t.failed(header.Name, err)
 			if err != nil {
 				return err
 			}
-			io.Copy(w, tr)
-			err = os.Chmod(fname, os.FileMode(header.Mode))
+		}
+	}
+	return t.partial()
+}
+
+// extractEntry extracts the entry whose header is header and whose content
+// is read from r.
+func (t *Tar) extractEntry(header *tar.Header, r io.Reader) (err error) {
+	fname := t.extractName(header.Name)
+	if fname == "" {
+		t.skip(SkippedRenamed, header.Name)
+		return nil
+	}
+	// extract is always relative to cwd, for now
+	// temporarily commented out because dst is no longer supported
+	// TODO add flag for destinatiion
+	name := fname
+	fname, err = t.safePath(header.Name, name, header.Typeflag == tar.TypeDir)
+	if err != nil {
+		return err
+	}
+	r = t.progressReader(t.ctxReader(r))
+	if header.Typeflag != tar.TypeDir {
+		t.entryStarted(header.Name, header.Size)
+		defer func() { t.entryFinished(header.Name, header.Size, err) }()
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		err = t.mkdirAll(fname, 0744)
+		if err != nil {
+			return err
+		}
+		// set the final element to the appropriate permission
+		err = os.Chmod(fname, os.FileMode(header.Mode))
+		if err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		// the parent directory is created if necessary
+		w, err := t.createFile(fname, header.ModTime)
+		if err != nil || w == nil {
+			return err
+		}
+		var v *verifier
+		if t.VerifyDigests {
+			v, err = tarVerifier(header)
 			if err != nil {
+				w.abort()
 				return err
 			}
-			w.Close()
-		default:
-			return fmt.Errorf("Unable to extract type: %c in file %s", header.Typeflag, fname)
 		}
+		dst := io.Writer(&timedWriter{w, &t.stats.Write})
+		if v != nil {
+			dst = io.MultiWriter(dst, v)
+		}
+		_, err = io.Copy(dst, r)
+		if err == nil && v != nil {
+			err = v.verify()
+		}
+		if err != nil {
+			w.abort()
+			return err
+		}
+		err = w.commit(os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		err = t.extractSymlink(header.Name, fname, name, header.Linkname, header.ModTime)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unable to extract type: %c in file %s", header.Typeflag, fname)
 	}
+	t.count(header.FileInfo().Mode(), 1)
 	return nil
 }
 
+// ExtractMember extracts the named file from the tarball using its index,
+// Name with IndexExt appended, or the index of a seekable tarball, so that
+// only the data from the index's last checkpoint before the file is
+// decompressed. If the tarball doesn't have an index, one is built, but not
+// saved; see WriteIndex.
+func (t *Tar) ExtractMember(name string) error {
+	f, err := os.Open(t.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if t.VerifyKey != nil {
+		err = verifySignature(f, t.Name, t.VerifyKey)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	x, err := ReadIndexFile(t.Name + IndexExt)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		x, err = ReadSeekableIndex(f, fi.Size())
+		if err == errNotSeekable {
+			x, err = BuildIndex(f, t.IndexSpan)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	header, r, err := x.Open(f, fi.Size(), name)
+	if err != nil {
+		return err
+	}
+	err = t.setTransforms()
+	if err != nil {
+		return err
+	}
+	t.begin(opExtract)
+	defer t.finish()
+	return t.extractEntry(header, r)
+}
+
+// WriteIndex builds an index of the tarball, see Index, and saves it to Name
+// with IndexExt appended.
+func (t *Tar) WriteIndex() error {
+	f, err := os.Open(t.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	x, err := BuildIndex(f, t.IndexSpan)
+	if err != nil {
+		return err
+	}
+	return x.WriteIndexFile(t.Name + IndexExt)
+}
+
 // ExtractGzip reads a GZip using the passed reader.
 func (t *Tar) ExtractGzip(src io.Reader) (err error) {
 	gR, err := gzip.NewReader(src)
@@ -359,9 +715,7 @@ func (t *Tar) ExtractZ(src io.Reader) error {
 // ExtractLZ4 extracts LZ4 compressed tarballs.
 func (t *Tar) ExtractLZ4(src io.Reader) error {
 	lzR := lz4.NewReader(src)
-	tr := tar.NewReader(lzR)
-	err := t.ExtractTar(tr)
-	return err
+	return t.ExtractTar(lzR)
 }
 
 func extractTarFile(hdr *tar.Header, dst string, src io.Reader) error {
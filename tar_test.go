@@ -1,6 +1,11 @@
 package carchivum
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -69,3 +74,122 @@ func TestGzipTar(t *testing.T) {
 		}
 	}
 }
+
+func TestLZ4Tar(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected creation of temp files to result in no error, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	for _, seekable := range []bool{false, true} {
+		newT := NewTar(filepath.Join(tmpDir, "test.tar.lz4"))
+		newT.Format = magicnum.LZ4
+		newT.Seekable = seekable
+		_, err = newT.Create(filepath.Join(tmpDir, "test"))
+		if err != nil {
+			t.Errorf("seekable %t: expected error to be nil, got %q", seekable, err)
+			continue
+		}
+		dst := filepath.Join(tmpDir, "extract")
+		err = Extract(dst, newT.Name)
+		if err != nil {
+			t.Errorf("seekable %t: expected error to be nil, got %q", seekable, err)
+			continue
+		}
+		for _, f := range TestFiles {
+			b, err := ioutil.ReadFile(filepath.Join(dst, f.name))
+			if err != nil || !bytes.Equal(b, f.content) {
+				t.Errorf("seekable %t: expected %s to be extracted, got %q, %v", seekable, f.name, b, err)
+			}
+		}
+		os.RemoveAll(dst)
+	}
+}
+
+func TestTarDigest(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected creation of temp files to result in no error, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.Hash = crypto.SHA256
+	_, err = newT.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected creation of tar to result in no error, got %q", err)
+		return
+	}
+	eDir := filepath.Join(tmpDir, "extract")
+	newT.OutDir = eDir
+	newT.VerifyDigests = true
+	err = newT.Extract()
+	if err != nil {
+		t.Errorf("expected extract of tar to not result in an error, got %q", err)
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(eDir, "test/test1.txt"))
+	if err != nil {
+		t.Errorf("expected read of extracted file to not error; got %q", err)
+	}
+	if string(fB) != "some content\n" {
+		t.Errorf("expected file contents to be %q got %q", "some content\n", string(fB))
+	}
+
+	// an entry whose content doesn't match its digest
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	hdr := &tar.Header{
+		Name:       "bad.txt",
+		Mode:       0644,
+		Size:       int64(len("tampered\n")),
+		PAXRecords: map[string]string{"CARCHIVUM.sha256": fmt.Sprintf("%x", sha256.Sum256([]byte("original\n")))},
+	}
+	tw.WriteHeader(hdr)
+	tw.Write([]byte("tampered\n"))
+	tw.Close()
+	bDir := filepath.Join(tmpDir, "bad")
+	badT := NewTar("bad.tar")
+	badT.OutDir = bDir
+	badT.VerifyDigests = true
+	err = badT.ExtractTar(buf)
+	if err == nil {
+		t.Error("expected extract of a tampered entry to result in an error, got none")
+	}
+	_, err = os.Stat(filepath.Join(bDir, "bad.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the tampered file to be removed, got %v", err)
+	}
+}
+
+func TestTarCreateTo(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected creation of temp files to result in no error, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var buf bytes.Buffer
+	newT := NewTar("")
+	cnt, err := newT.CreateTo(&buf, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected CreateTo to result in no error, got %q", err)
+		return
+	}
+	if cnt != 5 {
+		t.Errorf("Expected a count of 5; got %d", cnt)
+	}
+	eDir := filepath.Join(tmpDir, "extract")
+	newT.OutDir = eDir
+	err = newT.ExtractArchive(&buf)
+	if err != nil {
+		t.Errorf("expected extract of tar to not result in an error, got %q", err)
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(eDir, "test/dir/test1.txt"))
+	if err != nil {
+		t.Errorf("expected read of extracted file to not error; got %q", err)
+	}
+	if string(fB) != "different content\n" {
+		t.Errorf("expected file contents to be %q got %q", "different content\n", string(fB))
+	}
+}
@@ -0,0 +1,322 @@
+package carchivum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	magicnum "github.com/mohae/magicnum/compress"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted tarball is a compressed tarball wrapped in a container that
+// encrypts it, using AES-256-GCM, in chunks. The container starts with a
+// header:
+//
+//	magic       8 bytes  "CARCRYPT"
+//	version     1 byte
+//	kdf         1 byte   0: key, 1: scrypt
+//	scrypt      3 bytes  log2(N), r, p
+//	salt       16 bytes
+//	chunk size  4 bytes  big-endian
+//	nonce      7 bytes
+//
+// The header is followed by the sealed chunks. Each chunk's nonce is the
+// header's nonce, the chunk's big-endian uint32 sequence number, and a byte
+// that is 1 for the last chunk and 0 otherwise; the header is each chunk's
+// additional data. This makes it impossible to reorder, drop, or truncate
+// chunks, or to alter the header, without it being detected.
+//
+// The AES key is derived from the salt, and the passphrase using scrypt or
+// the EncryptionKey using HKDF-SHA256, so each tarball has its own key; a
+// nonce is never reused, even when many tarballs are encrypted with the same
+// EncryptionKey.
+const (
+	cryptMagic     = "CARCRYPT"
+	cryptVersion   = 1
+	cryptHeaderLen = 40
+	// CryptChunkSize is the amount of plaintext in each encrypted chunk.
+	CryptChunkSize = 64 * 1024
+	kdfRaw         = 0
+	kdfScrypt      = 1
+	// scrypt parameters
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+	// the scrypt parameters read from a header are bounded so that a
+	// hostile header can't exhaust the memory, or the time, it takes to
+	// derive the key; scrypt uses 128*r*N bytes.
+	maxScryptLogN = 20
+	maxScryptR    = 16
+	maxScryptP    = 4
+	maxScryptMem  = 256 * 1024 * 1024
+	// maxCryptChunkSize bounds the chunk size read from a header.
+	maxCryptChunkSize = 16 * 1024 * 1024
+)
+
+// IsEncrypted reports whether r starts with an encrypted tarball header.
+func IsEncrypted(r io.ReaderAt) (bool, error) {
+	b := make([]byte, len(cryptMagic))
+	_, err := r.ReadAt(b, 0)
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(b) == cryptMagic, nil
+}
+
+// encrypted reports whether the tarball is to be encrypted or decrypted.
+func (t *Tar) encrypted() bool {
+	return t.Passphrase != "" || t.EncryptionKey != nil
+}
+
+// cryptKey returns the key for a header's kdf parameters and salt.
+func (t *Tar) cryptKey(kdf byte, logN, r, p byte, salt []byte) ([]byte, error) {
+	switch kdf {
+	case kdfRaw:
+		if t.EncryptionKey == nil {
+			return nil, fmt.Errorf("%w; a key is required to decrypt it", ErrEncrypted)
+		}
+		if len(t.EncryptionKey) != 32 {
+			return nil, fmt.Errorf("a 32 byte encryption key is required, got %d bytes", len(t.EncryptionKey))
+		}
+		key := make([]byte, 32)
+		_, err := io.ReadFull(hkdf.New(sha256.New, t.EncryptionKey, salt, []byte(cryptMagic)), key)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case kdfScrypt:
+		if t.Passphrase == "" {
+			return nil, fmt.Errorf("%w; a passphrase is required to decrypt it", ErrEncrypted)
+		}
+		if logN == 0 || logN > maxScryptLogN || r == 0 || r > maxScryptR || p == 0 || p > maxScryptP || 128*int64(r)<<logN > maxScryptMem {
+			return nil, fmt.Errorf("invalid scrypt parameters: log2(N) %d, r %d, p %d", logN, r, p)
+		}
+		return scrypt.Key([]byte(t.Passphrase), salt, 1<<logN, int(r), int(p), 32)
+	}
+	return nil, fmt.Errorf("unknown key derivation function: %d", kdf)
+}
+
+// cryptWriter encrypts what is written to it in chunks. Close must be called
+// to write the last chunk.
+type cryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	seq    uint32
+	buf    []byte
+	out    []byte
+}
+
+// newCryptWriter writes the container header to w and returns a writer that
+// encrypts to w. If the Tar has a Passphrase, the key is derived from it;
+// otherwise its EncryptionKey is used.
+func (t *Tar) newCryptWriter(w io.Writer) (*cryptWriter, error) {
+	hdr := make([]byte, cryptHeaderLen)
+	copy(hdr, cryptMagic)
+	hdr[8] = cryptVersion
+	salt := hdr[13:29]
+	nonce := hdr[33:40]
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(hdr[29:33], CryptChunkSize)
+	if t.Passphrase != "" {
+		hdr[9] = kdfScrypt
+		hdr[10], hdr[11], hdr[12] = scryptLogN, scryptR, scryptP
+	}
+	key, err := t.cryptKey(hdr[9], hdr[10], hdr[11], hdr[12], salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newCryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptWriter{w: w, aead: aead, header: hdr, nonce: nonce, buf: make([]byte, 0, CryptChunkSize)}, nil
+}
+
+func newCryptAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// chunkNonce returns the nonce of the seq chunk.
+func chunkNonce(prefix []byte, seq uint32, last bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[7:], seq)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+func (c *cryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only sealed once there is more to write so that
+		// Close always has a last chunk to seal.
+		if len(c.buf) == cap(c.buf) {
+			err := c.seal(false)
+			if err != nil {
+				return n - len(p), err
+			}
+		}
+		i := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+i]
+		p = p[i:]
+	}
+	return n, nil
+}
+
+func (c *cryptWriter) seal(last bool) error {
+	if c.seq == ^uint32(0) {
+		return fmt.Errorf("encrypted tarball is too large: %w", ErrLimitExceeded)
+	}
+	c.out = c.aead.Seal(c.out[:0], chunkNonce(c.nonce, c.seq, last), c.buf, c.header)
+	c.seq++
+	c.buf = c.buf[:0]
+	_, err := c.w.Write(c.out)
+	return err
+}
+
+// Close seals and writes the last chunk. It does not close the underlying
+// writer.
+func (c *cryptWriter) Close() error {
+	return c.seal(true)
+}
+
+// cryptReader decrypts an encrypted tarball.
+type cryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	seq    uint32
+	chunk  []byte
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+// newCryptReader reads the container header from r and returns a reader that
+// decrypts the rest of r.
+func (t *Tar) newCryptReader(r io.Reader) (*cryptReader, error) {
+	hdr := make([]byte, cryptHeaderLen)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != cryptMagic {
+		return nil, fmt.Errorf("not an encrypted tarball")
+	}
+	if hdr[8] != cryptVersion {
+		return nil, fmt.Errorf("unsupported encrypted tarball version: %d", hdr[8])
+	}
+	size := binary.BigEndian.Uint32(hdr[29:33])
+	if size == 0 || size > maxCryptChunkSize {
+		return nil, fmt.Errorf("invalid encrypted tarball chunk size: %d", size)
+	}
+	key, err := t.cryptKey(hdr[9], hdr[10], hdr[11], hdr[12], hdr[13:29])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newCryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: hdr,
+		nonce:  hdr[33:40],
+		chunk:  make([]byte, int(size)+aead.Overhead()),
+	}, nil
+}
+
+func (c *cryptReader) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		err := c.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. The last chunk is the one that is
+// followed by EOF.
+func (c *cryptReader) open() error {
+	n, err := io.ReadFull(c.r, c.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, err = c.r.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	c.buf, err = c.aead.Open(c.buf[:0], chunkNonce(c.nonce, c.seq, last), c.chunk[:n], c.header)
+	if err != nil {
+		return fmt.Errorf("decryption failed: wrong key or corrupt tarball")
+	}
+	c.seq++
+	c.plain = c.buf
+	c.done = last
+	return nil
+}
+
+// decrypt returns a reader of the decrypted src. The Tar's Format is set to
+// the format of the decrypted content.
+func (t *Tar) decrypt(src io.Reader) (io.Reader, error) {
+	cr, err := t.newCryptReader(src)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(cr)
+	b, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	t.Format, err = magicnum.GetFormat(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return br, nil
+}
@@ -0,0 +1,169 @@
+package carchivum
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCryptRoundTrip(t *testing.T) {
+	tests := []int{0, 1, CryptChunkSize - 1, CryptChunkSize, CryptChunkSize + 1, 3 * CryptChunkSize}
+	key := bytes.Repeat([]byte{7}, 32)
+	for i, size := range tests {
+		plain := bytes.Repeat([]byte("carchivum"), size/9+1)[:size]
+		tb := &Tar{EncryptionKey: key}
+		var buf bytes.Buffer
+		cw, err := tb.newCryptWriter(&buf)
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		cw.Write(plain)
+		err = cw.Close()
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		sealed := buf.Bytes()
+		cr, err := tb.newCryptReader(bytes.NewReader(sealed))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		if !bytes.Equal(b, plain) {
+			t.Errorf("%d: decrypted content did not match the plaintext", i)
+		}
+		// truncating the encrypted stream must be detected.
+		cr, err = tb.newCryptReader(bytes.NewReader(sealed[:len(sealed)-1]))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(cr)
+		if err == nil {
+			t.Errorf("%d: expected reading a truncated stream to result in an error, got none", i)
+		}
+	}
+}
+
+func TestCryptKey(t *testing.T) {
+	tb := &Tar{EncryptionKey: bytes.Repeat([]byte{7}, 32)}
+	// each salt, i.e. tarball, has its own key
+	keys := map[string]bool{string(tb.EncryptionKey): true}
+	for _, salt := range [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)} {
+		key, err := tb.cryptKey(kdfRaw, 0, 0, 0, salt)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		if len(key) != 32 || keys[string(key)] {
+			t.Errorf("Expected a new 32 byte key for salt %x, got %x", salt, key)
+		}
+		keys[string(key)] = true
+	}
+}
+
+func TestCryptHostileHeader(t *testing.T) {
+	tb := &Tar{Passphrase: "passphrase"}
+	var buf bytes.Buffer
+	cw, err := tb.newCryptWriter(&buf)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	cw.Close()
+	tests := [][3]byte{
+		{30, scryptR, scryptP},
+		{25, scryptR, scryptP},
+		{maxScryptLogN, maxScryptR, scryptP},
+		{scryptLogN, 255, scryptP},
+		{scryptLogN, scryptR, 255},
+		{0, scryptR, scryptP},
+		{scryptLogN, 0, scryptP},
+	}
+	for _, test := range tests {
+		sealed := append([]byte(nil), buf.Bytes()...)
+		copy(sealed[10:13], test[:])
+		_, err = tb.newCryptReader(bytes.NewReader(sealed))
+		if err == nil {
+			t.Errorf("%v: expected the scrypt parameters to be rejected, got no error", test)
+		}
+	}
+}
+
+func TestEncryptedTar(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected creation of temp files to result in no error, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newT := NewTar(filepath.Join(tmpDir, "test.tgz"))
+	newT.Passphrase = "correct horse battery staple"
+	_, err = newT.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected creation of tar to result in no error, got %q", err)
+		return
+	}
+	f, err := os.Open(newT.Name)
+	if err != nil {
+		t.Errorf("expected open to result in no error, got %q", err)
+		return
+	}
+	encrypted, err := IsEncrypted(f)
+	f.Close()
+	if err != nil || !encrypted {
+		t.Errorf("expected the tarball to be encrypted, got %t %v", encrypted, err)
+	}
+	err = Extract(filepath.Join(tmpDir, "noKey"), newT.Name)
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected extract of an encrypted tarball without a passphrase to result in %v, got %v", ErrEncrypted, err)
+	}
+	b, err := ioutil.ReadFile(newT.Name)
+	if err != nil {
+		t.Errorf("expected read to result in no error, got %q", err)
+		return
+	}
+	err = ExtractReader(filepath.Join(tmpDir, "noKey"), bytes.NewReader(b))
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected extract of an encrypted tarball without a passphrase to result in %v, got %v", ErrEncrypted, err)
+	}
+	noKeyT := NewTar(newT.Name)
+	noKeyT.OutDir = filepath.Join(tmpDir, "noKey")
+	err = noKeyT.Extract()
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected extract of an encrypted tarball without a passphrase to result in %v, got %v", ErrEncrypted, err)
+	}
+
+	wrongT := NewTar(newT.Name)
+	wrongT.Passphrase = "wrong"
+	wrongT.OutDir = filepath.Join(tmpDir, "wrong")
+	err = wrongT.Extract()
+	if err == nil {
+		t.Error("expected extract with the wrong passphrase to result in an error, got none")
+	}
+
+	extT := NewTar(newT.Name)
+	extT.Passphrase = newT.Passphrase
+	extT.OutDir = filepath.Join(tmpDir, "extract")
+	err = extT.Extract()
+	if err != nil {
+		t.Errorf("expected extract of the encrypted tarball to result in no error, got %q", err)
+		return
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(extT.OutDir, "test/dir/test2.txt"))
+	if err != nil {
+		t.Errorf("expected read of extracted file to not error; got %q", err)
+	}
+	if string(fB) != "might be different content\n" {
+		t.Errorf("expected file contents to be %q got %q", "might be different content\n", string(fB))
+	}
+}
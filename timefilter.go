@@ -0,0 +1,118 @@
+package carchivum
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayouts are the layouts of the absolute times that ParseTime accepts;
+// times without a zone are in the local time zone.
+var TimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var relTime = regexp.MustCompile(`^\s*(\d+)\s*([a-zA-Z]+)`)
+
+// ParseTime parses s as an absolute time, in one of the TimeLayouts, or as a
+// time relative to now: a sequence of amounts and units, optionally
+// followed by "ago", e.g. "7d", "1h30m", or "2 weeks ago". The units are ms,
+// msec, millisecond, s, sec, second, m, min, minute, h, hr, hour, d, day, w,
+// week, mo, month, y, and year; those longer than two letters can be plural.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range TimeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	rel := strings.TrimSpace(strings.TrimSuffix(strings.ToLower(s), "ago"))
+	if rel == "" {
+		return unsetTime, fmt.Errorf("%q: invalid time", s)
+	}
+	t := now
+	for rel != "" {
+		m := relTime.FindStringSubmatch(rel)
+		if m == nil {
+			return unsetTime, fmt.Errorf("%q: invalid time", s)
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return unsetTime, fmt.Errorf("%q: invalid time: %s", s, err)
+		}
+		unit := m[2]
+		if len(unit) > 2 {
+			unit = strings.TrimSuffix(unit, "s")
+		}
+		switch unit {
+		case "ms", "msec", "millisecond":
+			t = t.Add(-time.Duration(n) * time.Millisecond)
+		case "s", "sec", "second":
+			t = t.Add(-time.Duration(n) * time.Second)
+		case "m", "min", "minute":
+			t = t.Add(-time.Duration(n) * time.Minute)
+		case "h", "hr", "hour":
+			t = t.Add(-time.Duration(n) * time.Hour)
+		case "d", "day":
+			t = t.AddDate(0, 0, -n)
+		case "w", "week":
+			t = t.AddDate(0, 0, -7*n)
+		case "mo", "month":
+			t = t.AddDate(0, -n, 0)
+		case "y", "year":
+			t = t.AddDate(-n, 0, 0)
+		default:
+			return unsetTime, fmt.Errorf("%q: unknown unit %q", s, m[2])
+		}
+		rel = strings.TrimSpace(rel[len(m[0]):])
+	}
+	return t, nil
+}
+
+// setTimeFilters sets the cutoffs the files' times are compared to: the
+// NewerMTime and OlderMTime or, if they aren't set, the times from Newer or
+// NewerFile and Older or OlderFile. The exported fields aren't changed, so
+// relative times are relative to the start of each operation.
+func (c *Car) setTimeFilters() error {
+	var err error
+	now := time.Now()
+	c.newer = c.NewerMTime
+	if c.newer == unsetTime {
+		c.newer, err = cutoff(c.Newer, c.NewerFile, now)
+		if err != nil {
+			return fmt.Errorf("newer: %s", err)
+		}
+	}
+	c.older = c.OlderMTime
+	if c.older == unsetTime {
+		c.older, err = cutoff(c.Older, c.OlderFile, now)
+		if err != nil {
+			return fmt.Errorf("older: %s", err)
+		}
+	}
+	return nil
+}
+
+// cutoff returns the time s, or the modification time of the file, if s
+// isn't set. If neither is set, the time is unset.
+func cutoff(s, file string, now time.Time) (time.Time, error) {
+	if s != "" {
+		return ParseTime(s, now)
+	}
+	if file != "" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return unsetTime, err
+		}
+		return fi.ModTime(), nil
+	}
+	return unsetTime, nil
+}
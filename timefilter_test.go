@@ -0,0 +1,150 @@
+package carchivum
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+		err      string
+	}{
+		{"2019-12-25", time.Date(2019, 12, 25, 0, 0, 0, 0, time.Local), ""},
+		{"2019-12-25 10:30", time.Date(2019, 12, 25, 10, 30, 0, 0, time.Local), ""},
+		{"2019-12-25T10:30:00Z", time.Date(2019, 12, 25, 10, 30, 0, 0, time.UTC), ""},
+		{"7d", now.AddDate(0, 0, -7), ""},
+		{"36h", now.Add(-36 * time.Hour), ""},
+		{"1h30m", now.Add(-90 * time.Minute), ""},
+		{"2 weeks ago", now.AddDate(0, 0, -14), ""},
+		{"1 month ago", time.Date(2020, 3, 2, 12, 0, 0, 0, time.UTC), ""},
+		{"1y 2mo", time.Date(2019, 1, 31, 12, 0, 0, 0, time.UTC), ""},
+		{"5ms", now.Add(-5 * time.Millisecond), ""},
+		{"5s", now.Add(-5 * time.Second), ""},
+		{"2 mins 30 secs", now.Add(-150 * time.Second), ""},
+		{"3 hrs", now.Add(-3 * time.Hour), ""},
+		{"10 fortnights", unsetTime, "unknown unit"},
+		{"yesterday", unsetTime, "invalid time"},
+		{"ago", unsetTime, "invalid time"},
+	}
+	for _, test := range tests {
+		tm, err := ParseTime(test.value, now)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error to contain %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.value, err)
+			continue
+		}
+		if !tm.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.value, test.expected, tm)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"src/new.txt", time.Hour},
+		{"src/week.txt", 7 * 24 * time.Hour},
+		{"src/dir/month.txt", 31 * 24 * time.Hour},
+		{"src/dir/year.log", 366 * 24 * time.Hour},
+	}
+	for _, f := range files {
+		p := filepath.Join(tmpDir, f.name)
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		err = ioutil.WriteFile(p, []byte(f.name), 0644)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		mtime := now.Add(-f.age)
+		err = os.Chtimes(p, mtime, mtime)
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+	}
+	tests := []struct {
+		name     string
+		set      func(c *Car)
+		expected []string
+	}{
+		{"newer", func(c *Car) { c.Newer = "2 days ago" }, []string{"src/new.txt"}},
+		{"newer file", func(c *Car) { c.NewerFile = filepath.Join(tmpDir, "src/dir/month.txt") }, []string{"src/new.txt", "src/week.txt"}},
+		{"older", func(c *Car) { c.Older = "30d" }, []string{"src/dir/month.txt", "src/dir/year.log"}},
+		{"between", func(c *Car) { c.Newer, c.Older = "1 year ago", "1 week ago" }, []string{"src/dir/month.txt", "src/week.txt"}},
+		// the files' change times are all now
+		{"ctime", func(c *Car) { c.Older, c.UseCTime = "2d", true }, nil},
+		{"include anchored", func(c *Car) { c.IncludeAnchored = "month" }, []string{"src/dir/month.txt"}},
+		{"include ext", func(c *Car) { c.IncludeExt, c.IncludeExtCount = []string{"log"}, 1 }, []string{"src/dir/year.log"}},
+		{"exclude anchored", func(c *Car) { c.ExcludeAnchored = "new" }, []string{"src/dir/month.txt", "src/dir/year.log", "src/week.txt"}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		newZ := NewZip("")
+		test.set(&newZ.Car)
+		_, err = newZ.CreateTo(&buf, filepath.Join(tmpDir, "src"))
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		zipFS, err := NewZipFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %q", test.name, err)
+			continue
+		}
+		var names []string
+		fs.WalkDir(zipFS, ".", func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				names = append(names, p)
+			}
+			return err
+		})
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, names)
+		}
+	}
+	// the exported times aren't set from Newer and Older
+	newZ := NewZip("")
+	newZ.Newer, newZ.Older = "1 year ago", "1 week ago"
+	_, err = newZ.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "src"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+	}
+	if newZ.NewerMTime != unsetTime || newZ.OlderMTime != unsetTime {
+		t.Errorf("Expected NewerMTime and OlderMTime to be unset, got %v and %v", newZ.NewerMTime, newZ.OlderMTime)
+	}
+	newZ = NewZip("")
+	newZ.Newer = "soon"
+	_, err = newZ.CreateTo(ioutil.Discard, filepath.Join(tmpDir, "src"))
+	if err == nil {
+		t.Error("Expected an invalid Newer time to be an error")
+	}
+}
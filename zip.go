@@ -3,14 +3,13 @@ package carchivum
 import (
 	"archive/zip"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 	"time"
-
-	"github.com/MichaelTJones/walk"
 )
 
 // Zip handles .zip archives.
@@ -18,6 +17,35 @@ type Zip struct {
 	Car
 	*zip.Writer
 	*os.File
+	// Password, if set, is used to encrypt the archived files using WinZip
+	// AES-256 encryption and to decrypt encrypted files, AES or ZipCrypto,
+	// when extracting.
+	Password string
+	// PasswordFunc, if set, is called with each entry's name for the
+	// password to use for that entry; it takes precedence over Password. An
+	// empty password means that the entry is not encrypted.
+	PasswordFunc func(name string) (string, error)
+	// Method is the compression method used for files that are compressed;
+	// the default is zip.Deflate. Methods other than zip.Store and
+	// zip.Deflate, e.g. ZstdMethod, need a compressor in Compressors; none
+	// are included.
+	Method uint16
+	// StoreExt is a list of extensions, e.g. jpg or mp4, of files that are
+	// stored instead of compressed.
+	StoreExt []string
+	// SniffCompressed stores files whose magic number shows that their
+	// content is already compressed.
+	SniffCompressed bool
+	// StoreRatio, if > 0, stores files whose trial compression ratio,
+	// compressed size / uncompressed size of their first TrialSize bytes, is
+	// greater than it.
+	StoreRatio float64
+	// Compressors and Decompressors, keyed by method, add support for
+	// compression methods other than Store and Deflate, e.g. ZstdMethod.
+	// None are included; only bzip2 entries can be extracted without a
+	// Decompressor.
+	Compressors   map[uint16]zip.Compressor
+	Decompressors map[uint16]zip.Decompressor
 }
 
 // NewZip returns an initialized Zip struct ready for use.
@@ -38,51 +66,82 @@ func (z *Zip) Create(src ...string) (cnt int, err error) {
 		return 0, fmt.Errorf("a source is required to create a zip archive")
 	}
 	// See if we can create the destination file before processing
-	z.File, err = os.OpenFile(z.Car.Name, os.O_RDWR|os.O_CREATE, 0666)
+	z.File, err = os.OpenFile(z.Car.Name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return 0, err
 	}
 	defer z.File.Close()
-	buf := new(bytes.Buffer)
-	z.Writer = zip.NewWriter(buf)
+	cnt, err = z.CreateTo(z.File, src...)
+	// the zip is kept if some of the files failed, see ContinueOnError.
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		// remove the partial zip
+		z.File.Close()
+		os.Remove(z.Car.Name)
+		return 0, err
+	}
+	err = z.File.Close()
+	if err != nil {
+		return 0, err
+	}
+	if z.SignKey != nil {
+		err = Sign(z.Car.Name, z.SignKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if partial != nil {
+		return cnt, partial
+	}
+	return cnt, nil
+}
+
+// CreateTo creates a zip from src and writes it to w as it is created.
+// ZIP64 records are used when an entry, or the archive, exceeds 4 GiB or
+// there are more than 65,535 entries.
+func (z *Zip) CreateTo(w io.Writer, src ...string) (cnt int, err error) {
+	// If there aren't any sources, return err
+	if len(src) == 0 {
+		return 0, fmt.Errorf("a source is required to create a zip archive")
+	}
+	if m := z.compressMethod(); m != zip.Store && m != zip.Deflate && z.Compressors[m] == nil {
+		return 0, fmt.Errorf("%w: method %d, see Zip.Compressors", zip.ErrAlgorithm, m)
+	}
+	err = z.startProgress(src)
+	if err != nil {
+		return 0, err
+	}
+	defer z.finish()
+	z.Writer = zip.NewWriter(z.progressWriter(w))
 	defer z.Writer.Close()
+	for m, c := range z.Compressors {
+		z.Writer.RegisterCompressor(m, c)
+	}
 	// Set up the file queue and its drain.
-	z.FileCh = make(chan *os.File)
+	z.entries = make(chan *entry)
+	z.werr = nil
 	wait, err := z.write()
 	if err != nil {
 		return 0, err
 	}
-	var fullPath string
 	// Walk the sources, add each file to the queue.
 	// This isn't limited as a large number of sources is not expected.
-	visitor := func(p string, fi os.FileInfo, err error) error {
-		return z.AddFile(fullPath, p, fi, err)
+	err = z.addSources(src)
+	// the writer closes any files that are still queued
+	close(z.entries)
+	wait.Wait()
+	if err != nil {
+		return 0, err
 	}
-	var wg sync.WaitGroup
-	wg.Add(len(src) - 1)
-	for _, source := range src {
-		// first get the absolute, its needed either way
-		fullPath, err = filepath.Abs(source)
-		if err != nil {
-			return 0, err
-		}
-		err = walk.Walk(fullPath, visitor)
-		if err != nil {
-			return 0, err
-		}
+	if z.werr != nil {
+		return 0, z.werr
 	}
-	wg.Wait()
-	close(z.FileCh)
-	wait.Wait()
-	z.Writer.Close()
-	// Copy the zip
-	_, err = z.File.Write(buf.Bytes())
+	err = z.Writer.Close()
 	if err != nil {
 		return 0, err
 	}
-	z.File.Close()
 	z.setDelta()
-	return int(z.Car.files), nil
+	return int(z.Car.files), z.partial()
 }
 
 // ZipBytes takes a string and bytes and returns a zip archive of the bytes
@@ -112,7 +171,6 @@ func copyTo(w io.Writer, z *zip.File) (int64, error) {
 	return io.Copy(w, f)
 }
 
-//
 // Because zip can't be parallized because  `Create/CreateHEader` implicitly
 // closes the writer and I don't feel like writing a parallized zip writer,
 // we spawn a new goroutine for each file to read and pipe them to the zipper
@@ -122,63 +180,294 @@ func copyTo(w io.Writer, z *zip.File) (int64, error) {
 func (z *Zip) write() (*sync.WaitGroup, error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go func() error {
+	go func() {
 		defer wg.Done()
-		for f := range z.FileCh {
-			defer f.Close()
-			info, err := f.Stat()
-			if err != nil {
-				return err
+		for e := range z.entries {
+			if z.werr == nil {
+				z.werr = z.ctxErr()
 			}
-			if info.IsDir() {
+			if z.werr != nil {
+				e.close()
 				continue
 			}
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
+			start := time.Now()
+			z.werr = z.writeFile(e)
+			z.stats.archive += time.Since(start)
+			// the zip is intact if the header wasn't written.
+			if z.werr != nil && !e.written {
+				z.werr = z.failed(e.Name, z.werr)
+				if z.werr == nil {
+					z.uncount(e)
+				}
 			}
-			header.Name = f.Name()
-			fw, err := z.Writer.CreateHeader(header)
+		}
+	}()
+	return &wg, nil
+}
+
+// writeFile adds e to the zip and closes it. If a Hash is set, e's digest is
+// computed before it is added and stored in an extra field of the entry's
+// header. If there is a password for the entry, it is
+// encrypted using AES-256; an encrypted entry doesn't get a digest, as the
+// extra field is cleartext and would reveal the digest of its content.
+func (z *Zip) writeFile(e *entry) (err error) {
+	defer e.close()
+	info, err := e.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	z.entryStarted(e.Name, info.Size())
+	defer func() { z.entryFinished(e.Name, info.Size(), err) }()
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = e.Name
+	if z.Reproducible {
+		header.Modified = z.modTime(header.Modified)
+		header.SetMode(z.perm(info.Mode()))
+	}
+	if c := e.hook; c != nil {
+		if c.Mode != 0 {
+			header.SetMode(info.Mode()&^os.ModePerm | c.Mode.Perm())
+		}
+		if !c.ModTime.IsZero() {
+			header.Modified = c.ModTime
+		}
+	}
+	var r io.Reader
+	if f, ok := e.file.(*specialFile); ok {
+		// a symlink's content is its target; zips can't hold other
+		// special files.
+		if f.link == "" {
+			return nil
+		}
+		header.Method = zip.Store
+		r = strings.NewReader(f.link)
+	} else {
+		header.Method, err = z.method(e)
+		if err != nil {
+			return err
+		}
+		// the method may have spooled the file, see entry.seekable.
+		r = e.file
+	}
+	password, err := z.password(header.Name)
+	if err != nil {
+		return err
+	}
+	if z.Hash != 0 && password == "" {
+		if !z.Hash.Available() {
+			return fmt.Errorf("%s is not a supported digest hash", z.Hash)
+		}
+		rs, ok := r.(io.ReadSeeker)
+		if !ok {
+			rs, err = e.seekable()
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(fw, f)
+			r = rs
+		}
+		sum, err := fileDigest(rs, z.Hash)
+		if err != nil {
+			return err
+		}
+		extra, err := zipDigestExtra(z.Hash, sum)
+		if err != nil {
+			return err
+		}
+		header.Extra = append(header.Extra, extra...)
+	}
+	r = z.progressReader(z.ctxReader(r))
+	e.written = true
+	if password != "" {
+		err = z.writeEncrypted(header, r, password)
+	} else {
+		var fw io.Writer
+		fw, err = z.Writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, r)
+	}
+	return err
+}
+
+// Extract the content of src, a zip archive. The destination is CWD, unless
+// OutputDir is specified; then it will be a child of the output dir. If a
+// VerifyKey is set, the src is verified against its detached signature before
+// anything is extracted.
+func (z *Zip) Extract() error {
+	f, err := os.Open(z.Car.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if z.VerifyKey != nil {
+		err = verifySignature(f, z.Car.Name, z.VerifyKey)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return z.ExtractReaderAt(f, fi.Size())
+}
+
+// ExtractReaderAt extracts the content of the zip archive, of size bytes,
+// read from r, e.g. an in-memory or remote zip.
+func (z *Zip) ExtractReaderAt(r io.ReaderAt, size int64) error {
+	z.begin(opExtract)
+	z.stats.BytesIn = size
+	defer z.finish()
+	err := z.setTransforms()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	z.registerDecompressors(zr)
+	for _, f := range zr.File {
+		err = z.ctxErr()
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			err = z.extractEntry(&f.FileHeader, nil)
+		} else {
+			err = z.extractFile(f)
+		}
+		if err != nil {
+			err = z.failed(f.Name, err)
 			if err != nil {
 				return err
 			}
 		}
-		return nil
-	}()
-	return &wg, nil
+	}
+	return z.partial()
 }
 
-// Extract the content of src, a zip archive. The destination is CWD, unless
-// OutputDir is specified; then it will be a child of the output dir.
-func (z *Zip) Extract() error {
-	r, err := zip.OpenReader(z.Car.Name)
+// extractFile extracts f, a file in the zip.
+func (z *Zip) extractFile(f *zip.File) error {
+	rc, err := z.openEntry(f)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
-	for _, f := range r.File {
-		rc, err := f.Open()
+	defer rc.Close()
+	err = z.extractEntry(&f.FileHeader, rc)
+	var cerr *CorruptError
+	if errors.Is(err, zip.ErrChecksum) && !errors.As(err, &cerr) {
+		offset, _ := f.DataOffset()
+		err = &CorruptError{Name: f.Name, Offset: offset, Err: err}
+	}
+	return err
+}
+
+// extractEntry writes the content of the entry, read from r, to its file in
+// OutDir. A nil r is a directory entry and a symlink entry's content is its
+// target. If VerifyDigests is set and the entry has a digest, the file is
+// checked against it.
+func (z *Zip) extractEntry(hdr *zip.FileHeader, r io.Reader) (err error) {
+	name := hdr.Name
+	rel := z.extractName(name)
+	if rel == "" {
+		z.skip(SkippedRenamed, name)
+		// a streamed entry's content must still be read.
+		if r != nil {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		return nil
+	}
+	fname, err := z.safePath(name, rel, r == nil)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		err = z.mkdirAll(fname, 0755)
 		if err != nil {
 			return err
 		}
-		err = os.MkdirAll(filepath.Join(z.OutDir, filepath.Dir(f.Name)), 0755)
+		z.count(hdr.Mode(), 1)
+		return nil
+	}
+	r = z.progressReader(z.ctxReader(r))
+	size := int64(hdr.UncompressedSize64)
+	z.entryStarted(name, size)
+	defer func() { z.entryFinished(name, size, err) }()
+	var v *verifier
+	if z.VerifyDigests {
+		v, err = zipVerifier(name, hdr.Extra)
 		if err != nil {
 			return err
 		}
-		dF, err := os.Create(filepath.Join(z.OutDir, f.Name))
+	}
+	if hdr.Mode()&os.ModeSymlink != 0 {
+		var target strings.Builder
+		dst := io.Writer(&target)
+		if v != nil {
+			dst = io.MultiWriter(dst, v)
+		}
+		n, err := io.Copy(dst, io.LimitReader(r, maxLinkLen+1))
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(dF, rc)
+		if n > maxLinkLen {
+			return &CorruptError{Name: name, Offset: -1, Err: fmt.Errorf("symlink target is longer than %d bytes", maxLinkLen)}
+		}
+		if v != nil {
+			err = v.verify()
+			if err != nil {
+				return err
+			}
+		}
+		err = z.extractSymlink(name, fname, rel, target.String(), hdr.Modified)
 		if err != nil {
 			return err
 		}
-		rc.Close()
-		dF.Close()
+		z.count(hdr.Mode(), 1)
+		return nil
+	}
+	dF, err := z.createFile(fname, hdr.Modified)
+	if err != nil {
+		return err
+	}
+	if dF == nil {
+		// the existing file is kept
+		_, err = io.Copy(io.Discard, r)
+		return err
+	}
+	dst := io.Writer(&timedWriter{dF, &z.stats.Write})
+	if v != nil {
+		dst = io.MultiWriter(dst, v)
+	}
+	_, err = io.Copy(dst, r)
+	if err == nil && v != nil {
+		err = v.verify()
+	}
+	if err != nil {
+		dF.abort()
+		return err
+	}
+	perm := hdr.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	err = dF.commit(perm)
+	if err != nil {
+		return err
 	}
+	z.count(hdr.Mode(), 1)
 	return nil
 }
@@ -1,7 +1,11 @@
 package carchivum
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -115,3 +119,187 @@ func TestZip(t *testing.T) {
 	}
 	RemoveTmpDir(tmpDir)
 }
+
+func TestZipDigest(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	newZ.Hash = crypto.SHA256
+	_, err = newZ.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	eDir := filepath.Join(tmpDir, "extract")
+	newZ.OutDir = eDir
+	newZ.VerifyDigests = true
+	err = newZ.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(eDir, "test/dir/test2.txt"))
+	if err != nil {
+		t.Errorf("expected error to be nil, got %q", err)
+	}
+	if string(fB) != "might be different content\n" {
+		t.Errorf("expected %q, got %q", "might be different content\n", string(fB))
+	}
+	// the digest is in the entry's local header too
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "test.zip"))
+	if err != nil || len(b) < localHeaderLen {
+		t.Errorf("Expected error to be nil, got %v", err)
+		return
+	}
+	hdr, err := readLocalHeader(bytes.NewReader(b[localHeaderLen:]), b[:localHeaderLen])
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	v, err := zipVerifier(hdr.Name, hdr.Extra)
+	if err != nil || v == nil {
+		t.Errorf("expected %s's local header to have a digest, got %v", hdr.Name, err)
+	}
+
+	// an entry whose content doesn't match its digest
+	sum := sha256.Sum256([]byte("original\n"))
+	extra, _ := zipDigestExtra(crypto.SHA256, sum[:])
+	bad := filepath.Join(tmpDir, "bad.zip")
+	f, _ := os.Create(bad)
+	zw := zip.NewWriter(f)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "bad.txt", Method: zip.Deflate, Extra: extra})
+	w.Write([]byte("tampered\n"))
+	zw.Close()
+	f.Close()
+	badZ := NewZip(bad)
+	badZ.OutDir = filepath.Join(tmpDir, "bad")
+	badZ.VerifyDigests = true
+	err = badZ.Extract()
+	if err == nil {
+		t.Error("expected extract of a tampered entry to result in an error, got none")
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "bad", "bad.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the tampered file to be removed, got %v", err)
+	}
+}
+
+func TestZipMultipleSources(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	name := filepath.Join(tmpDir, "test.zip")
+	// an existing, larger, file must be replaced, not partially overwritten.
+	err = ioutil.WriteFile(name, bytes.Repeat([]byte("x"), 1<<16), 0644)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = os.Mkdir(filepath.Join(tmpDir, "other"), 0755)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "other", "other.txt"), []byte("other content\n"), 0644)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newZ := NewZip(name)
+	cnt, err := newZ.Create(filepath.Join(tmpDir, "test"), filepath.Join(tmpDir, "other"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if cnt != 6 {
+		t.Errorf("Expected 6 got %d", cnt)
+	}
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer r.Close()
+	if len(r.File) != 5 {
+		t.Errorf("Expected 5 entries, got %d", len(r.File))
+	}
+}
+
+func TestZip64Extract(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping extraction of a zip with more than 65535 entries in short mode")
+	}
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	name := filepath.Join(tmpDir, "many.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// more entries than fit in the end of central directory record
+	const n = 1<<16 + 1
+	zw := zip.NewWriter(f)
+	for i := 0; i < n; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("d%d/%d", i%256, i), Method: zip.Store})
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		fmt.Fprint(w, i)
+	}
+	zw.Close()
+	f.Close()
+	newZ := NewZip(name)
+	newZ.OutDir = filepath.Join(tmpDir, "extract")
+	err = newZ.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(newZ.OutDir, "d0", fmt.Sprint(n-1)))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if string(fB) != fmt.Sprint(n-1) {
+		t.Errorf("expected %d, got %s", n-1, fB)
+	}
+}
+
+func TestZipCreateTo(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var buf bytes.Buffer
+	newZ := NewZip("")
+	cnt, err := newZ.CreateTo(&buf, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if cnt != 5 {
+		t.Errorf("Expected 5 got %d", cnt)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if len(r.File) != 4 {
+		t.Errorf("Expected 4 entries, got %d", len(r.File))
+	}
+}
@@ -0,0 +1,446 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// WinZip AES encryption, see https://www.winzip.com/en/support/aes-encryption/
+const (
+	// aesMethod is the method recorded in the header of an AES encrypted
+	// entry; the entry's actual method is in its AES extra field.
+	aesMethod = 99
+	// aesExtraID is the id of the AES extra field.
+	aesExtraID = 0x9901
+	// Entries are encrypted using AE-2, which doesn't store the CRC of the
+	// plaintext.
+	aesVendorVersion = 2
+	// aesStrength256 is the strength recorded for AES-256.
+	aesStrength256 = 3
+	aesIterations  = 1000
+	aesPVLen       = 2
+	aesMACLen      = 10
+	// zipEncrypted is the general purpose flag bit that marks an encrypted
+	// entry.
+	zipEncrypted = 0x1
+	// zipDataDescriptor is the general purpose flag bit that marks an entry
+	// whose sizes and CRC follow its data.
+	zipDataDescriptor = 0x8
+	// zipCryptoHeaderLen is the length of the ZipCrypto encryption header.
+	zipCryptoHeaderLen = 12
+)
+
+// aesKeyLen returns the key length for an AES strength.
+func aesKeyLen(strength byte) (int, error) {
+	switch strength {
+	case 1:
+		return 16, nil
+	case 2:
+		return 24, nil
+	case 3:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unknown AES strength %d", strength)
+}
+
+// aesKeys derives the encryption key, the authentication key, and the
+// password verification value from the password and salt.
+func aesKeys(password string, salt []byte, keyLen int) (key, authKey, pv []byte) {
+	b := pbkdf2.Key([]byte(password), salt, aesIterations, 2*keyLen+aesPVLen, sha1.New)
+	return b[:keyLen], b[keyLen : 2*keyLen], b[2*keyLen:]
+}
+
+// aesExtra returns the AES extra field for an entry whose actual compression
+// method is method.
+func aesExtra(method uint16) []byte {
+	b := make([]byte, 11)
+	binary.LittleEndian.PutUint16(b, aesExtraID)
+	binary.LittleEndian.PutUint16(b[2:], 7)
+	binary.LittleEndian.PutUint16(b[4:], aesVendorVersion)
+	copy(b[6:], "AE")
+	b[8] = aesStrength256
+	binary.LittleEndian.PutUint16(b[9:], method)
+	return b
+}
+
+// parseAESExtra returns the vendor version, strength, and actual compression
+// method from an entry's AES extra field.
+func parseAESExtra(extra []byte) (version uint16, strength byte, method uint16, err error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		data := extra[:size]
+		extra = extra[size:]
+		if id != aesExtraID {
+			continue
+		}
+		if len(data) < 7 || string(data[2:4]) != "AE" {
+			break
+		}
+		return binary.LittleEndian.Uint16(data), data[4], binary.LittleEndian.Uint16(data[5:]), nil
+	}
+	return 0, 0, 0, fmt.Errorf("AES extra field not found")
+}
+
+// winzipCTR is the CTR mode used by WinZip: the counter is little-endian and
+// starts at 1.
+type winzipCTR struct {
+	b   cipher.Block
+	ctr [aes.BlockSize]byte
+	ks  [aes.BlockSize]byte
+	pos int
+}
+
+func newWinzipCTR(b cipher.Block) *winzipCTR {
+	return &winzipCTR{b: b, pos: aes.BlockSize}
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for j := range c.ctr {
+				c.ctr[j]++
+				if c.ctr[j] != 0 {
+					break
+				}
+			}
+			c.b.Encrypt(c.ks[:], c.ctr[:])
+			c.pos = 0
+		}
+		dst[i] = src[i] ^ c.ks[c.pos]
+		c.pos++
+	}
+}
+
+// aesWriter encrypts what is written to it. The salt and password
+// verification value are written when it is created and the authentication
+// code is written when it is closed.
+type aesWriter struct {
+	w   io.Writer
+	ctr *winzipCTR
+	mac hash.Hash
+	buf []byte
+}
+
+func newAESWriter(w io.Writer, password string) (*aesWriter, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, authKey, pv := aesKeys(password, salt, 32)
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append(salt, pv...))
+	if err != nil {
+		return nil, err
+	}
+	return &aesWriter{w: w, ctr: newWinzipCTR(b), mac: hmac.New(sha1.New, authKey)}, nil
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	buf := a.buf[:len(p)]
+	a.ctr.XORKeyStream(buf, p)
+	a.mac.Write(buf)
+	return a.w.Write(buf)
+}
+
+func (a *aesWriter) Close() error {
+	_, err := a.w.Write(a.mac.Sum(nil)[:aesMACLen])
+	return err
+}
+
+// aesReader decrypts n bytes of data read from r. Once the data has been
+// read, the authentication code that follows it is checked.
+type aesReader struct {
+	name string
+	r    io.Reader
+	data io.Reader
+	ctr  *winzipCTR
+	mac  hash.Hash
+}
+
+func newAESReader(r io.Reader, name, password string, strength byte, size uint64) (*aesReader, error) {
+	keyLen, err := aesKeyLen(strength)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	saltLen := keyLen / 2
+	if size < uint64(saltLen+aesPVLen+aesMACLen) {
+		return nil, fmt.Errorf("%s: encrypted entry is too short", name)
+	}
+	b := make([]byte, saltLen+aesPVLen)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	key, authKey, pv := aesKeys(password, b[:saltLen], keyLen)
+	if subtle.ConstantTimeCompare(pv, b[saltLen:]) != 1 {
+		return nil, fmt.Errorf("%s: incorrect password", name)
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(size) - int64(saltLen+aesPVLen+aesMACLen)
+	return &aesReader{name: name, r: r, data: io.LimitReader(r, n), ctr: newWinzipCTR(blk), mac: hmac.New(sha1.New, authKey)}, nil
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	n, err := a.data.Read(p)
+	if n > 0 {
+		a.mac.Write(p[:n])
+		a.ctr.XORKeyStream(p[:n], p[:n])
+	}
+	if err == io.EOF {
+		code := make([]byte, aesMACLen)
+		_, rerr := io.ReadFull(a.r, code)
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			// the entry, or its MAC, is truncated.
+			return n, &CorruptError{Name: a.name, Offset: -1, Err: io.ErrUnexpectedEOF}
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+		if !hmac.Equal(code, a.mac.Sum(nil)[:aesMACLen]) {
+			return n, &CorruptError{Name: a.name, Offset: -1, Err: fmt.Errorf("authentication failed")}
+		}
+	}
+	return n, err
+}
+
+// zipCryptoKeys is the state of the traditional PKWARE encryption.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func crcUpdate(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crcUpdate(k[0], b)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crcUpdate(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) stream() byte {
+	t := k[2] | 2
+	return byte(t * (t ^ 1) >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i := range p {
+		p[i] ^= k.stream()
+		k.update(p[i])
+	}
+}
+
+// zipCryptoReader decrypts data read from r that was encrypted using the
+// traditional PKWARE encryption, ZipCrypto.
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func newZipCryptoReader(r io.Reader, f *zip.FileHeader, password string) (*zipCryptoReader, error) {
+	if f.CompressedSize64 < zipCryptoHeaderLen {
+		return nil, fmt.Errorf("%s: encrypted entry is too short", f.Name)
+	}
+	keys := newZipCryptoKeys(password)
+	hdr := make([]byte, zipCryptoHeaderLen)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	keys.decrypt(hdr)
+	// The last byte of the header is used to check the password: it is
+	// the high byte of the CRC or, if the entry has a data descriptor, of
+	// the DOS time.
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&zipDataDescriptor != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if hdr[zipCryptoHeaderLen-1] != check {
+		return nil, fmt.Errorf("%s: incorrect password", f.Name)
+	}
+	return &zipCryptoReader{r: io.LimitReader(r, int64(f.CompressedSize64-zipCryptoHeaderLen)), keys: keys}, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.keys.decrypt(p[:n])
+	return n, err
+}
+
+// crcReader checks the CRC of what is read once the expected number of bytes
+// have been read.
+type crcReader struct {
+	name string
+	r    io.Reader
+	crc  hash.Hash32
+	want uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	if err == io.EOF && c.crc.Sum32() != c.want {
+		return n, &CorruptError{Name: c.name, Offset: -1, Err: zip.ErrChecksum}
+	}
+	return n, err
+}
+
+// password returns the password for the named entry.
+func (z *Zip) password(name string) (string, error) {
+	if z.PasswordFunc != nil {
+		return z.PasswordFunc(name)
+	}
+	return z.Password, nil
+}
+
+// openEntry returns a reader of the entry's content, decrypting it if it is
+// encrypted.
+func (z *Zip) openEntry(f *zip.File) (io.ReadCloser, error) {
+	if f.Flags&zipEncrypted == 0 {
+		return f.Open()
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	return z.openEncrypted(&f.FileHeader, raw)
+}
+
+// openEncrypted returns a reader of the content of the encrypted entry
+// described by f, whose raw data is read from raw. Both WinZip AES and
+// ZipCrypto encrypted entries are supported; f's CompressedSize64 must be
+// set.
+func (z *Zip) openEncrypted(f *zip.FileHeader, raw io.Reader) (io.ReadCloser, error) {
+	password, err := z.password(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%s: entry is encrypted and no password was supplied", f.Name)
+	}
+	if f.Method != aesMethod {
+		cr, err := newZipCryptoReader(raw, f, password)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := z.decompressor(cr, f.Name, f.Method)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{&crcReader{name: f.Name, r: rc, crc: crc32.NewIEEE(), want: f.CRC32}, rc}, nil
+	}
+	version, strength, method, err := parseAESExtra(f.Extra)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.Name, err)
+	}
+	ar, err := newAESReader(raw, f.Name, password, strength, f.CompressedSize64)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := z.decompressor(ar, f.Name, method)
+	if err != nil {
+		return nil, err
+	}
+	// AE-1 entries also have the CRC of their plaintext.
+	if version == 1 {
+		return readCloser{&crcReader{name: f.Name, r: rc, crc: crc32.NewIEEE(), want: f.CRC32}, rc}, nil
+	}
+	return rc, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeEncrypted adds the content read from r to the zip as an AES-256
+// encrypted entry. The encrypted entry is spooled to a temporary file as its
+// compressed size must be known before it can be added.
+func (z *Zip) writeEncrypted(header *zip.FileHeader, r io.Reader, password string) error {
+	tmp, err := os.CreateTemp("", "carchivum")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	aw, err := newAESWriter(tmp, password)
+	if err != nil {
+		return err
+	}
+	cw, err := z.compressor(aw, header.Name, header.Method)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(cw, r)
+	if err != nil {
+		return err
+	}
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+	err = aw.Close()
+	if err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header.Extra = append(header.Extra, aesExtra(header.Method)...)
+	header.Method = aesMethod
+	header.Flags |= zipEncrypted
+	header.CRC32 = 0
+	header.UncompressedSize64 = uint64(n)
+	header.CompressedSize64 = uint64(size)
+	fw, err := z.Writer.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, tmp)
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,176 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipAES(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	newZ := NewZip(filepath.Join(tmpDir, "test.zip"))
+	newZ.Password = "secret"
+	newZ.Hash = crypto.SHA256
+	_, err = newZ.Create(filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	r, err := zip.OpenReader(newZ.Car.Name)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	for _, f := range r.File {
+		if f.Method != aesMethod || f.Flags&zipEncrypted == 0 {
+			t.Errorf("%s: expected an AES encrypted entry, got method %d flags %#x", f.Name, f.Method, f.Flags)
+		}
+		// the digest would be in cleartext
+		v, err := zipVerifier(f.Name, f.Extra)
+		if v != nil || err != nil {
+			t.Errorf("%s: expected no digest, got %v, %v", f.Name, v, err)
+		}
+	}
+	r.Close()
+
+	tests := []struct {
+		password    string
+		expectedErr bool
+	}{
+		{"secret", false},
+		{"wrong", true},
+		{"", true},
+	}
+	for i, test := range tests {
+		eDir := filepath.Join(tmpDir, "extract", test.password)
+		extZ := NewZip(newZ.Car.Name)
+		extZ.OutDir = eDir
+		extZ.PasswordFunc = func(name string) (string, error) { return test.password, nil }
+		err = extZ.Extract()
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%d: expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		fB, err := ioutil.ReadFile(filepath.Join(eDir, "test/dir/test1.txt"))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		if string(fB) != "different content\n" {
+			t.Errorf("%d: expected %q, got %q", i, "different content\n", string(fB))
+		}
+	}
+}
+
+func TestZipAESTruncated(t *testing.T) {
+	var b bytes.Buffer
+	aw, err := newAESWriter(&b, "secret")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	aw.Write([]byte("some content that is encrypted"))
+	aw.Close()
+	// the MAC, part of it, and part of the data are missing.
+	for _, n := range []int{aesMACLen, 3, aesMACLen + 5} {
+		sealed := b.Bytes()[:b.Len()-n]
+		ar, err := newAESReader(bytes.NewReader(sealed), "test", "secret", aesStrength256, uint64(b.Len()))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", n, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(ar)
+		if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%d: expected a corrupt entry error for %v, got %v", n, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+// zipCryptoEncrypt encrypts p in place; it's the inverse of decrypt.
+func (k *zipCryptoKeys) zipCryptoEncrypt(p []byte) {
+	for i := range p {
+		c := p[i]
+		p[i] ^= k.stream()
+		k.update(c)
+	}
+}
+
+func TestZipCrypto(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	content := []byte("legacy encrypted content\n")
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	fw.Write(content)
+	fw.Close()
+	crc := crc32.ChecksumIEEE(content)
+	// the encryption header: 11 random bytes and the check byte
+	data := append([]byte("abcdefghijk"), byte(crc>>24))
+	data = append(data, compressed.Bytes()...)
+	newZipCryptoKeys("secret").zipCryptoEncrypt(data)
+
+	name := filepath.Join(tmpDir, "legacy.zip")
+	f, _ := os.Create(name)
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "legacy.txt",
+		Method:             zip.Deflate,
+		Flags:              zipEncrypted,
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(content)),
+	})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	w.Write(data)
+	zw.Close()
+	f.Close()
+
+	newZ := NewZip(name)
+	newZ.OutDir = filepath.Join(tmpDir, "wrong")
+	newZ.Password = "wrong"
+	err = newZ.Extract()
+	if err == nil {
+		t.Error("expected extract with the wrong password to result in an error, got none")
+	}
+	newZ.OutDir = filepath.Join(tmpDir, "extract")
+	newZ.Password = "secret"
+	err = newZ.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(tmpDir, "extract", "legacy.txt"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if !bytes.Equal(fB, content) {
+		t.Errorf("expected %q, got %q", content, fB)
+	}
+}
@@ -0,0 +1,202 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	magicnum "github.com/mohae/magicnum/compress"
+)
+
+// Compression methods, other than Store and Deflate, that some zip readers
+// support. They are only the methods' ids: Zip doesn't include a compressor
+// for either, or a zstd decompressor, so to use them register your own, e.g.
+// one from a zstd package, in Zip.Compressors and Zip.Decompressors. Bzip2
+// compressed entries can be extracted without one.
+const (
+	Bzip2Method uint16 = 12
+	ZstdMethod  uint16 = 93
+)
+
+// TrialSize is the amount of a file that is compressed to determine its
+// compression ratio when Zip.StoreRatio is set.
+const TrialSize = 64 * 1024
+
+// compressedMagic are the magic numbers of common file formats, not handled
+// by magicnum, whose content is already compressed.
+var compressedMagic = []struct {
+	offset int
+	magic  []byte
+}{
+	{0, []byte{0xff, 0xd8, 0xff}},                            // jpeg
+	{0, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}}, // png
+	{0, []byte("GIF8")},                                      // gif
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}},                      // zstd
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},              // xz
+	{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}},            // 7z
+	{4, []byte("ftyp")},                                      // mp4, mov, heic
+	{8, []byte("WEBP")},                                      // webp
+}
+
+// method returns the compression method to use for the entry e. Files whose
+// extension is in StoreExt are stored. If SniffCompressed is set, files whose
+// magic number shows that they are already compressed are stored. If a
+// StoreRatio is set, files whose trial compression ratio exceeds it are
+// stored. Everything else is compressed using Method, or Deflate if Method
+// isn't set.
+func (z *Zip) method(e *entry) (uint16, error) {
+	if len(z.StoreExt) > 0 {
+		ext := strings.TrimPrefix(path.Ext(e.Name), ".")
+		for _, v := range z.StoreExt {
+			if strings.EqualFold(ext, strings.TrimPrefix(v, ".")) {
+				return zip.Store, nil
+			}
+		}
+	}
+	if z.SniffCompressed || z.StoreRatio > 0 {
+		f, err := e.seekable()
+		if err != nil {
+			return 0, err
+		}
+		return z.sniffMethod(f)
+	}
+	return z.compressMethod(), nil
+}
+
+// sniffMethod returns the compression method to use for f, based on its
+// content.
+func (z *Zip) sniffMethod(f io.ReaderAt) (uint16, error) {
+	if z.SniffCompressed {
+		compressed, err := isCompressed(f)
+		if err != nil {
+			return 0, err
+		}
+		if compressed {
+			return zip.Store, nil
+		}
+	}
+	if z.StoreRatio > 0 {
+		ratio, err := trialRatio(f)
+		if err != nil {
+			return 0, err
+		}
+		if ratio > z.StoreRatio {
+			return zip.Store, nil
+		}
+	}
+	return z.compressMethod(), nil
+}
+
+// compressMethod returns the method used for files that are compressed.
+func (z *Zip) compressMethod() uint16 {
+	if z.Method != 0 {
+		return z.Method
+	}
+	return zip.Deflate
+}
+
+// isCompressed sniffs r's magic number to see if its content is already
+// compressed.
+func isCompressed(r io.ReaderAt) (bool, error) {
+	format, err := magicnum.GetFormat(r)
+	if err != nil {
+		return false, err
+	}
+	switch format {
+	case magicnum.GZip, magicnum.BZip2, magicnum.LZ4, magicnum.Zip:
+		return true, nil
+	}
+	b := make([]byte, 16)
+	n, err := r.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	b = b[:n]
+	for _, m := range compressedMagic {
+		if len(b) >= m.offset+len(m.magic) && bytes.Equal(b[m.offset:m.offset+len(m.magic)], m.magic) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// trialRatio returns the ratio of the compressed size to the uncompressed
+// size of the first TrialSize bytes of r when they are deflated.
+func trialRatio(r io.ReaderAt) (float64, error) {
+	b := make([]byte, TrialSize)
+	n, err := r.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	var cnt countWriter
+	fw, err := flate.NewWriter(&cnt, flate.BestSpeed)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fw.Write(b[:n])
+	if err != nil {
+		return 0, err
+	}
+	err = fw.Close()
+	if err != nil {
+		return 0, err
+	}
+	return float64(cnt) / float64(n), nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// compressor returns a writer that compresses to w according to method.
+func (z *Zip) compressor(w io.Writer, name string, method uint16) (io.WriteCloser, error) {
+	switch method {
+	case zip.Store:
+		return nopWriteCloser{w}, nil
+	case zip.Deflate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	if c, ok := z.Compressors[method]; ok {
+		return c(w)
+	}
+	return nil, fmt.Errorf("%s: %w: method %d, see Zip.Compressors", name, zip.ErrAlgorithm, method)
+}
+
+// decompressor returns a reader that decompresses r according to method.
+func (z *Zip) decompressor(r io.Reader, name string, method uint16) (io.ReadCloser, error) {
+	switch method {
+	case zip.Store:
+		return io.NopCloser(r), nil
+	case zip.Deflate:
+		return flate.NewReader(r), nil
+	}
+	if d, ok := z.Decompressors[method]; ok {
+		return d(r), nil
+	}
+	if method == Bzip2Method {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("%s: %w: method %d, see Zip.Decompressors", name, zip.ErrAlgorithm, method)
+}
+
+// registerDecompressors registers the Decompressors, and bzip2, with r.
+func (z *Zip) registerDecompressors(r *zip.Reader) {
+	r.RegisterDecompressor(Bzip2Method, func(r io.Reader) io.ReadCloser {
+		return io.NopCloser(bzip2.NewReader(r))
+	})
+	for m, d := range z.Decompressors {
+		r.RegisterDecompressor(m, d)
+	}
+}
@@ -0,0 +1,148 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipMethod(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	err = os.Chdir(tmpDir)
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	os.Mkdir("src", 0755)
+	text := bytes.Repeat([]byte("compressible text "), 1000)
+	random := make([]byte, 8192)
+	rand.Read(random)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(text)
+	gw.Close()
+	files := map[string][]byte{
+		"src/text.txt":   text,
+		"src/photo.JPG":  text,
+		"src/random.bin": random,
+		"src/text.gz":    gz.Bytes(),
+	}
+	for name, b := range files {
+		ioutil.WriteFile(name, b, 0644)
+	}
+	tests := []struct {
+		storeExt []string
+		sniff    bool
+		ratio    float64
+		expected map[string]uint16
+	}{
+		{nil, false, 0, map[string]uint16{"src/text.txt": zip.Deflate, "src/photo.JPG": zip.Deflate, "src/random.bin": zip.Deflate, "src/text.gz": zip.Deflate}},
+		{[]string{"jpg"}, false, 0, map[string]uint16{"src/text.txt": zip.Deflate, "src/photo.JPG": zip.Store, "src/random.bin": zip.Deflate, "src/text.gz": zip.Deflate}},
+		{nil, true, 0, map[string]uint16{"src/text.txt": zip.Deflate, "src/photo.JPG": zip.Deflate, "src/random.bin": zip.Deflate, "src/text.gz": zip.Store}},
+		{nil, false, 0.9, map[string]uint16{"src/text.txt": zip.Deflate, "src/photo.JPG": zip.Deflate, "src/random.bin": zip.Store, "src/text.gz": zip.Store}},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		newZ := NewZip("")
+		newZ.StoreExt = test.storeExt
+		newZ.SniffCompressed = test.sniff
+		newZ.StoreRatio = test.ratio
+		_, err = newZ.CreateTo(&buf, "src")
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		for _, f := range r.File {
+			if f.Method != test.expected[f.Name] {
+				t.Errorf("%d: %s: expected method %d, got %d", i, f.Name, test.expected[f.Name], f.Method)
+			}
+		}
+	}
+	// a method without a compressor fails before anything is archived
+	newZ := NewZip("")
+	newZ.Method = ZstdMethod
+	_, err = newZ.CreateTo(ioutil.Discard, "src")
+	if !errors.Is(err, zip.ErrAlgorithm) {
+		t.Errorf("Expected %v, got %v", zip.ErrAlgorithm, err)
+	}
+	// registered ones are used
+	newZ.Compressors = map[uint16]zip.Compressor{ZstdMethod: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.BestSpeed) }}
+	newZ.Decompressors = map[uint16]zip.Decompressor{ZstdMethod: flate.NewReader}
+	var buf bytes.Buffer
+	_, err = newZ.CreateTo(&buf, "src")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	newZ.OutDir = filepath.Join(tmpDir, "out")
+	err = newZ.ExtractReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(newZ.OutDir, "src", "text.txt"))
+	if err != nil || !bytes.Equal(b, text) {
+		t.Errorf("Expected text.txt to be extracted, got %v", err)
+	}
+}
+
+func TestZipBzip2Extract(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "car")
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	content := "bzip2 content\n"
+	compressed := []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x09\x0e\xf5\xcb\x00\x00\x01\xd9\x80\x00\x10\x40\x00\x10\x00\x1a\x21\xc4\x10\x20\x00\x22\x00\x0c\x84\x0d\x03\x40\x40\x89\x93\xa7\x81\x43\xe2\xee\x48\xa7\x0a\x12\x01\x21\xde\xb9\x60")
+	name := filepath.Join(tmpDir, "bzip2.zip")
+	f, _ := os.Create(name)
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "bzip2.txt",
+		Method:             Bzip2Method,
+		CRC32:              0x618cfbab,
+		CompressedSize64:   uint64(len(compressed)),
+		UncompressedSize64: uint64(len(content)),
+	})
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	w.Write(compressed)
+	zw.Close()
+	f.Close()
+	newZ := NewZip(name)
+	newZ.OutDir = filepath.Join(tmpDir, "extract")
+	err = newZ.Extract()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	fB, err := ioutil.ReadFile(filepath.Join(newZ.OutDir, "bzip2.txt"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	if string(fB) != content {
+		t.Errorf("expected %q, got %q", content, fB)
+	}
+}
@@ -0,0 +1,275 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// zip record signatures and lengths used when streaming a zip.
+const (
+	localHeaderSig      = 0x04034b50
+	centralHeaderSig    = 0x02014b50
+	dataDescriptorSig   = 0x08074b50
+	endSig              = 0x06054b50
+	zip64EndSig         = 0x06064b50
+	localHeaderLen      = 30
+	zip64ExtraID        = 0x0001
+	uint32max           = 1<<32 - 1
+	dataDescriptorLen   = 12
+	dataDescriptor64Len = 20
+)
+
+// ExtractReader extracts the zip read from r as it is streamed, e.g. from
+// stdin or an HTTP body, using the entries' local file headers instead of
+// the central directory at the end of the zip.
+//
+// This is best-effort: an entry whose sizes follow its data, in a data
+// descriptor, can only be extracted if it is deflated, and encrypted entries
+// can only be extracted if their sizes are in their local header. Entry modes
+// are stored in the central directory so symlinks are extracted as regular
+// files holding their target.
+// When the zip is available as an io.ReaderAt, use ExtractReaderAt.
+func (z *Zip) ExtractReader(r io.Reader) error {
+	z.begin(opExtract)
+	cr := &countReader{r: bufio.NewReader(r)}
+	defer func() {
+		z.stats.BytesIn = cr.n
+		z.finish()
+	}()
+	err := z.setTransforms()
+	if err != nil {
+		return err
+	}
+	for {
+		err := z.ctxErr()
+		if err != nil {
+			return err
+		}
+		var b [localHeaderLen]byte
+		_, err = io.ReadFull(cr, b[:4])
+		if err != nil {
+			return truncated(err, cr.n)
+		}
+		switch binary.LittleEndian.Uint32(b[:4]) {
+		case localHeaderSig:
+		case centralHeaderSig, endSig, zip64EndSig:
+			// the entries have all been read
+			return z.partial()
+		default:
+			return &CorruptError{Offset: cr.n - 4, Err: fmt.Errorf("zip: not a valid local file header")}
+		}
+		_, err = io.ReadFull(cr, b[4:])
+		if err != nil {
+			return truncated(err, cr.n)
+		}
+		hdr, err := readLocalHeader(cr, b[:])
+		if err != nil {
+			return truncated(err, cr.n)
+		}
+		err = z.extractStreamEntry(cr, hdr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// truncated returns a *CorruptError for err, read at off, if it is the end
+// of the stream: a zip ends with its central directory, which the stream
+// ended before. Other errors are returned as they are.
+func truncated(err error, off int64) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &CorruptError{Offset: off, Err: io.ErrUnexpectedEOF}
+	}
+	return err
+}
+
+// readLocalHeader returns the header of an entry whose fixed length local
+// header fields are in b; the name and extra field are read from r.
+func readLocalHeader(r io.Reader, b []byte) (*zip.FileHeader, error) {
+	le := binary.LittleEndian
+	hdr := &zip.FileHeader{
+		Flags:              le.Uint16(b[6:]),
+		Method:             le.Uint16(b[8:]),
+		ModifiedTime:       le.Uint16(b[10:]),
+		ModifiedDate:       le.Uint16(b[12:]),
+		CRC32:              le.Uint32(b[14:]),
+		CompressedSize64:   uint64(le.Uint32(b[18:])),
+		UncompressedSize64: uint64(le.Uint32(b[22:])),
+	}
+	v := make([]byte, int(le.Uint16(b[26:]))+int(le.Uint16(b[28:])))
+	_, err := io.ReadFull(r, v)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = string(v[:le.Uint16(b[26:])])
+	hdr.Extra = v[le.Uint16(b[26:]):]
+	// sizes that don't fit are in the zip64 extra field, uncompressed
+	// first.
+	extra := hdr.Extra
+	for len(extra) >= 4 {
+		id := le.Uint16(extra)
+		size := int(le.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		data := extra[:size]
+		extra = extra[size:]
+		if id != zip64ExtraID {
+			continue
+		}
+		if hdr.UncompressedSize64 == uint32max && len(data) >= 8 {
+			hdr.UncompressedSize64 = le.Uint64(data)
+			data = data[8:]
+		}
+		if hdr.CompressedSize64 == uint32max && len(data) >= 8 {
+			hdr.CompressedSize64 = le.Uint64(data)
+		}
+	}
+	hdr.Modified = msDosTime(hdr.ModifiedDate, hdr.ModifiedTime)
+	return hdr, nil
+}
+
+// msDosTime returns the MS-DOS date and time as a time in UTC.
+func msDosTime(d, t uint16) time.Time {
+	return time.Date(int(d>>9)+1980, time.Month(d>>5&0xf), int(d&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
+
+// extractStreamEntry extracts the entry described by hdr whose data is read
+// from r.
+func (z *Zip) extractStreamEntry(r *countReader, hdr *zip.FileHeader) error {
+	descriptor := hdr.Flags&zipDataDescriptor != 0
+	start := r.n
+	var raw io.Reader
+	var rc io.ReadCloser
+	var err error
+	crc := crc32.NewIEEE()
+	var uncompressed countWriter
+	switch {
+	case strings.HasSuffix(hdr.Name, "/") && (descriptor || hdr.CompressedSize64 == 0):
+		// a directory; it doesn't have any content.
+	case descriptor && (hdr.Flags&zipEncrypted != 0 || hdr.Method != zip.Deflate):
+		return fmt.Errorf("%s: entries with a data descriptor must be deflated, and not encrypted, to be streamed", hdr.Name)
+	case descriptor:
+		// the deflate stream ends itself; as r is an io.ByteReader, the
+		// decompressor doesn't read past the end of it.
+		rc = flate.NewReader(r)
+	case hdr.Flags&zipEncrypted != 0:
+		raw = io.LimitReader(r, int64(hdr.CompressedSize64))
+		rc, err = z.openEncrypted(hdr, raw)
+	default:
+		raw = io.LimitReader(r, int64(hdr.CompressedSize64))
+		rc, err = z.decompressor(raw, hdr.Name, hdr.Method)
+		if err == nil {
+			rc = readCloser{&crcReader{name: hdr.Name, r: rc, crc: crc, want: hdr.CRC32}, rc}
+		}
+	}
+	if err != nil {
+		return z.skipStreamEntry(hdr.Name, raw, err)
+	}
+	if rc == nil {
+		err = z.extractEntry(hdr, nil)
+	} else {
+		if descriptor {
+			rc = readCloser{io.TeeReader(rc, io.MultiWriter(crc, &uncompressed)), rc}
+		}
+		err = z.extractEntry(hdr, rc)
+		rc.Close()
+	}
+	if err != nil {
+		return z.skipStreamEntry(hdr.Name, raw, err)
+	}
+	// skip anything the entry's reader didn't consume
+	if raw != nil {
+		_, err = io.Copy(io.Discard, raw)
+		if err != nil {
+			return err
+		}
+	}
+	if !descriptor {
+		return nil
+	}
+	zip64 := r.n-start >= uint32max || uncompressed >= uint32max
+	err = readDataDescriptor(r, hdr.Name, zip64, crc.Sum32(), rc != nil)
+	// the descriptor has been read, so the next entry can be.
+	var cerr *CorruptError
+	if errors.As(err, &cerr) {
+		return z.failed(hdr.Name, err)
+	}
+	return err
+}
+
+// skipStreamEntry skips the rest of an entry that failed with err, if
+// ContinueOnError is set and the entry's size is known, i.e. raw, the rest of
+// its data, isn't nil; see failed. Otherwise err is returned.
+func (z *Zip) skipStreamEntry(name string, raw io.Reader, err error) error {
+	if raw == nil || !z.ContinueOnError {
+		return err
+	}
+	_, derr := io.Copy(io.Discard, raw)
+	if derr != nil {
+		return derr
+	}
+	return z.failed(name, err)
+}
+
+// readDataDescriptor reads the data descriptor that follows an entry's data
+// and, if check is true, checks the entry's CRC against it. The sizes are
+// 64-bit if the entry's sizes required ZIP64.
+func readDataDescriptor(r *countReader, name string, zip64 bool, crc uint32, check bool) error {
+	var b [4 + dataDescriptor64Len]byte
+	_, err := io.ReadFull(r, b[:4])
+	if err != nil {
+		return err
+	}
+	// the signature is optional
+	v := b[:4]
+	if binary.LittleEndian.Uint32(v) == dataDescriptorSig {
+		_, err = io.ReadFull(r, v)
+		if err != nil {
+			return err
+		}
+	}
+	n := dataDescriptorLen - 4
+	if zip64 {
+		n = dataDescriptor64Len - 4
+	}
+	_, err = io.ReadFull(r, b[4:4+n])
+	if err != nil {
+		return err
+	}
+	if check && binary.LittleEndian.Uint32(v) != crc {
+		return &CorruptError{Name: name, Offset: -1, Err: zip.ErrChecksum}
+	}
+	return nil
+}
+
+// countReader counts the bytes read from r. It is an io.ByteReader so that
+// decompressors don't read past the end of an entry's data.
+type countReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
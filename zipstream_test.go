@@ -0,0 +1,151 @@
+package carchivum
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestZipExtractReader(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	// deflated entries with data descriptors
+	var deflated bytes.Buffer
+	_, err = NewZip("").CreateTo(&deflated, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// encrypted entries
+	var encrypted bytes.Buffer
+	encZ := NewZip("")
+	encZ.Password = "secret"
+	_, err = encZ.CreateTo(&encrypted, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	// a directory and stored entries whose sizes are in the local header
+	var stored bytes.Buffer
+	zw := zip.NewWriter(&stored)
+	zw.CreateHeader(&zip.FileHeader{Name: "test/"})
+	for _, f := range TestFiles {
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               f.name,
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(f.content),
+			CompressedSize64:   uint64(len(f.content)),
+			UncompressedSize64: uint64(len(f.content)),
+		})
+		if err != nil {
+			t.Errorf("Expected error to be nil, got %q", err)
+			return
+		}
+		w.Write(f.content)
+	}
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		b        []byte
+		password string
+	}{
+		{"deflated", deflated.Bytes(), ""},
+		{"encrypted", encrypted.Bytes(), "secret"},
+		{"stored", stored.Bytes(), ""},
+	}
+	for _, test := range tests {
+		for _, at := range []bool{false, true} {
+			newZ := NewZip("")
+			newZ.Password = test.password
+			newZ.OutDir = filepath.Join(tmpDir, "extract", test.name)
+			if at {
+				newZ.OutDir += "At"
+				err = newZ.ExtractReaderAt(bytes.NewReader(test.b), int64(len(test.b)))
+			} else {
+				err = newZ.ExtractReader(bytes.NewReader(test.b))
+			}
+			if err != nil {
+				t.Errorf("%s %t: expected error to be nil, got %q", test.name, at, err)
+				continue
+			}
+			for _, f := range TestFiles {
+				fB, err := ioutil.ReadFile(filepath.Join(newZ.OutDir, f.name))
+				if err != nil {
+					t.Errorf("%s %t: expected error to be nil, got %q", test.name, at, err)
+					continue
+				}
+				if !bytes.Equal(fB, f.content) {
+					t.Errorf("%s %t: expected %q, got %q", test.name, at, f.content, fB)
+				}
+			}
+		}
+	}
+
+	// corrupt the content of a stored entry
+	b := bytes.Replace(stored.Bytes(), []byte("some content"), []byte("some CONTENT"), 1)
+	newZ := NewZip("")
+	newZ.OutDir = filepath.Join(tmpDir, "extract", "corrupt")
+	err = newZ.ExtractReader(bytes.NewReader(b))
+	if err == nil {
+		t.Error("expected extract of a corrupt entry to result in an error, got none")
+	}
+	// truncate it before the central directory: in a signature, in a local
+	// header, and after an entry.
+	b = stored.Bytes()
+	next := bytes.Index(b[4:], []byte("PK\x03\x04")) + 4
+	for _, n := range []int{2, 10, next, next + 2} {
+		newZ = NewZip("")
+		newZ.OutDir = filepath.Join(tmpDir, "extract", "truncated")
+		err = newZ.ExtractReader(bytes.NewReader(b[:n]))
+		if !errors.Is(err, ErrCorrupt) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d: expected a corrupt entry error for %v, got %v", n, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestExtractReader(t *testing.T) {
+	tmpDir, err := CreateTempFiles()
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	defer RemoveTmpDir(tmpDir)
+	var tgz, zipped bytes.Buffer
+	_, err = NewTar("").CreateTo(&tgz, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	_, err = NewZip("").CreateTo(&zipped, filepath.Join(tmpDir, "test"))
+	if err != nil {
+		t.Errorf("Expected error to be nil, got %q", err)
+		return
+	}
+	for i, buf := range []*bytes.Buffer{&tgz, &zipped} {
+		eDir := filepath.Join(tmpDir, "extract", strconv.Itoa(i))
+		err = ExtractReader(eDir, buf)
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		fB, err := ioutil.ReadFile(filepath.Join(eDir, "test/test2.txt"))
+		if err != nil {
+			t.Errorf("%d: expected error to be nil, got %q", i, err)
+			continue
+		}
+		if string(fB) != "some more content\n" {
+			t.Errorf("%d: expected %q, got %q", i, "some more content\n", fB)
+		}
+	}
+}